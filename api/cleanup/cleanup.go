@@ -4,6 +4,10 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"tmpemail_api/config"
@@ -79,28 +83,46 @@ func cleanupAddress(db *database.DB, cfg *config.Config, address string, logger
 	}
 
 	// Delete email files from filesystem
-	emailFilesDeleted := 0
-	for _, path := range emailPaths {
+	emailFilesDeleted := deleteFiles(emailPaths, cfg.CleanupWorkers, func(path string) bool {
+		// A .eml shared across recipients is kept until its last reference is cleaned up
+		if refs, err := db.CountOtherEmailFileReferences(path, address); err != nil || refs > 0 {
+			if err != nil {
+				logger.Warn("Failed to check email file references, keeping file", "error", err, "path", path)
+			}
+			return false
+		}
 		if err := os.Remove(path); err != nil {
 			if !os.IsNotExist(err) {
 				logger.Warn("Failed to delete email file", "error", err, "path", path)
 			}
-		} else {
-			emailFilesDeleted++
+			return false
 		}
-	}
+		return true
+	})
 
 	// Delete attachment files from filesystem
-	attachmentFilesDeleted := 0
-	for _, path := range attachmentPaths {
+	attachmentFilesDeleted := deleteFiles(attachmentPaths, cfg.CleanupWorkers, func(path string) bool {
+		if refs, err := db.CountOtherAttachmentFileReferences(path, address); err != nil || refs > 0 {
+			if err != nil {
+				logger.Warn("Failed to check attachment file references, keeping file", "error", err, "path", path)
+			}
+			return false
+		}
 		if err := os.Remove(path); err != nil {
 			if !os.IsNotExist(err) {
 				logger.Warn("Failed to delete attachment file", "error", err, "path", path)
 			}
-		} else {
-			attachmentFilesDeleted++
+			return false
 		}
-	}
+		// Attachments stored with their original directory structure leave
+		// per-email directories behind; prune them once empty
+		root := cfg.StoragePathFor(address)
+		if cfg.ColdStoragePath != "" && strings.HasPrefix(path, filepath.Clean(cfg.ColdStoragePath)+string(filepath.Separator)) {
+			root = cfg.ColdStoragePath
+		}
+		removeEmptyParents(path, root)
+		return true
+	})
 
 	// Delete address from database (cascade deletes emails and attachments)
 	if err := db.DeleteAddress(address); err != nil {
@@ -115,3 +137,46 @@ func cleanupAddress(db *database.DB, cfg *config.Config, address string, logger
 
 	return nil
 }
+
+// deleteFiles calls remove for every path using a bounded pool of workers
+// and returns the number of paths for which remove reported success
+func deleteFiles(paths []string, workers int, remove func(path string) bool) int {
+	workers = min(max(workers, 1), len(paths))
+
+	jobs := make(chan string)
+	var deleted atomic.Int64
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				if remove(path) {
+					deleted.Add(1)
+				}
+			}
+		}()
+	}
+
+	for _, path := range paths {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+
+	return int(deleted.Load())
+}
+
+// removeEmptyParents removes empty directories from the parent of path up to (but not including) root
+func removeEmptyParents(path, root string) {
+	root = filepath.Clean(root)
+	dir := filepath.Dir(filepath.Clean(path))
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		// os.Remove fails on non-empty directories, which ends the walk
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
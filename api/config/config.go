@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -19,24 +21,77 @@ type Config struct {
 	EmailDomain string
 
 	// Storage
-	StoragePath string
+	StoragePath        string
+	DomainStoragePaths map[string]string // Recipient domain -> storage root; other domains use StoragePath
+	ColdStoragePath    string            // Root of cold-tier attachments (must match the Email Service)
+
+	// Request handling
+	RequestTimeout time.Duration // Deadline for API request handling, including DB queries (0 = none)
 
 	// Expiration
 	DefaultExpiration time.Duration
 
+	// Address generation
+	AddressStyle    string // "readable" (adjective-noun-number) or "passphrase" (words only)
+	PassphraseWords int    // Number of words in passphrase-style addresses
+
 	// Rate limiting
 	RateLimitGenerate int // Rate limit for /api/v1/generate (per minute)
 	RateLimitAPI      int // Rate limit for other API endpoints (per minute)
 	RateLimitWS       int // Rate limit for WebSocket connections (per minute)
+	RateLimitMaxIPs   int // Max client IPs tracked per limiter; least recently seen are evicted (0 = unlimited)
 
 	// CORS
 	AllowedOrigins []string
 
+	// Address matching
+	DotInsensitiveDomains []string // Domains whose local parts ignore dots (foo.bar == foobar), Gmail-style
+	ValidateAddressFormat bool     // Reject malformed {address} parameters with 400 before querying the database
+	MaxAddressLength      int      // Longest accepted address in bytes when validating the format
+
 	// Cleanup
 	CleanupInterval time.Duration
+	CleanupWorkers  int // Max concurrent file deletions per address during cleanup
 
 	// Storage quota
 	StorageQuotaPerAddress int64 // Max storage per address in bytes (0 = unlimited)
+	QuotaWarningPercent    int   // Usage percentage of the quota at which quota_warning is set (0 = disabled)
+
+	// Email listing
+	MaxEmailsPerList int // Hard cap on emails returned by list endpoints (0 = unlimited)
+
+	// Read state
+	AutoMarkRead bool // Mark emails read when their content is fetched (overridable with mark_read/peek)
+
+	// Internal API authentication (must match the Email Service key)
+	InternalAPIKey string // Shared key required in X-Internal-Token on /internal routes (empty = unauthenticated, admin disabled)
+
+	// WebSocket catch-up for clients reconnecting with since_seq
+	WSEventBufferSize   int           // Max recent broadcasts kept per address (0 = disabled, reconnects always resync)
+	WSEventBufferMaxAge time.Duration // Broadcasts older than this are dropped from the buffer
+
+	// WebSocket duplicate suppression
+	WSDedupWindow time.Duration // Drop a broadcast repeating the type and email ID of one sent to the same address this recently (0 = disabled)
+
+	// WebSocket hub robustness
+	WSRecoverPanics bool // Log and skip a hub event whose handling panics instead of crashing the process
+
+	// Forwarding to a permanent mailbox (opt-in per address with forward_to at generation)
+	ForwardingEnabled     bool   // Allow addresses to forward received mail
+	ForwardSMTPAddr       string // Outbound SMTP relay as host:port
+	ForwardFrom           string // Envelope sender of forwarded mail (empty = forwarder@<EmailDomain>)
+	ForwardSMTPUsername   string // Relay username (empty = no authentication)
+	ForwardSMTPPassword   string
+	ForwardRateLimit      int      // Max forwarded emails per address per minute
+	ForwardAllowedDomains []string // Domains forward_to may target; empty = no target is accepted
+
+	// TLS for outbound connections that carry email content (forwarding relay)
+	OutboundTLSPolicy     string // "opportunistic" (encrypt when offered, else send in plaintext) or "required" (refuse to send unencrypted)
+	OutboundTLSMinVersion string // Lowest accepted TLS version: "1.0", "1.1", "1.2" or "1.3"
+
+	// Encryption at rest (must match the Email Service keys)
+	EncryptionKey     string   // Base64-encoded 32-byte AES-256 key (empty = disabled)
+	EncryptionOldKeys []string // Previous keys, still accepted for decryption after rotation
 }
 
 // Load loads configuration from environment variables with defaults
@@ -46,14 +101,73 @@ func Load() *Config {
 		Port:                   getEnv("TMPEMAIL_PORT", "8080"),
 		EmailDomain:            getEnv("TMPEMAIL_DOMAIN", "tmpemail.xyz"),
 		StoragePath:            getEnv("TMPEMAIL_STORAGE_PATH", "/var/mail/tmpemail"),
+		DomainStoragePaths:     getEnvMap("TMPEMAIL_DOMAIN_STORAGE_PATHS", nil),
+		ColdStoragePath:        getEnv("TMPEMAIL_COLD_STORAGE_PATH", ""),
+		RequestTimeout:         getDurationEnv("TMPEMAIL_REQUEST_TIMEOUT", 10*time.Second),
 		DefaultExpiration:      getDurationEnv("TMPEMAIL_DEFAULT_EXPIRATION", 1*time.Hour),
+		AddressStyle:           getEnv("TMPEMAIL_ADDRESS_STYLE", "readable"), // "readable" or "passphrase"
+		PassphraseWords:        getIntEnv("TMPEMAIL_PASSPHRASE_WORDS", 3),
 		RateLimitGenerate:      getIntEnv("TMPEMAIL_RATE_LIMIT_GENERATE", 10), // 10 req/min for generate
 		RateLimitAPI:           getIntEnv("TMPEMAIL_RATE_LIMIT_API", 60),      // 60 req/min for email retrieval
 		RateLimitWS:            getIntEnv("TMPEMAIL_RATE_LIMIT_WS", 5),        // 5 connections/min for WebSocket
+		RateLimitMaxIPs:        getIntEnv("TMPEMAIL_RATE_LIMIT_MAX_IPS", 100000),
 		AllowedOrigins:         getEnvList("TMPEMAIL_ALLOWED_ORIGINS", []string{"http://localhost:5173", "http://localhost:3000"}),
+		DotInsensitiveDomains:  getEnvList("TMPEMAIL_DOT_INSENSITIVE_DOMAINS", nil),
+		ValidateAddressFormat:  getBoolEnv("TMPEMAIL_VALIDATE_ADDRESS_FORMAT", true),
+		MaxAddressLength:       getIntEnv("TMPEMAIL_MAX_ADDRESS_LENGTH", 254),
 		CleanupInterval:        getDurationEnv("TMPEMAIL_CLEANUP_INTERVAL", 5*time.Minute),
+		CleanupWorkers:         getIntEnv("TMPEMAIL_CLEANUP_WORKERS", 4),
 		StorageQuotaPerAddress: getInt64Env("TMPEMAIL_STORAGE_QUOTA", 50*1024*1024), // 50MB default
+		QuotaWarningPercent:    getIntEnv("TMPEMAIL_QUOTA_WARNING_PERCENT", 90),
+		MaxEmailsPerList:       getIntEnv("TMPEMAIL_MAX_EMAILS_PER_LIST", 500),
+		AutoMarkRead:           getBoolEnv("TMPEMAIL_AUTO_MARK_READ", false),
+		InternalAPIKey:         getEnv("TMPEMAIL_INTERNAL_API_KEY", ""),
+		EncryptionKey:          getEnv("TMPEMAIL_ENCRYPTION_KEY", ""),
+		EncryptionOldKeys:      getEnvList("TMPEMAIL_ENCRYPTION_OLD_KEYS", nil),
+
+		WSEventBufferSize:   getIntEnv("TMPEMAIL_WS_EVENT_BUFFER_SIZE", 100),
+		WSEventBufferMaxAge: getDurationEnv("TMPEMAIL_WS_EVENT_BUFFER_MAX_AGE", 5*time.Minute),
+
+		WSDedupWindow: getDurationEnv("TMPEMAIL_WS_DEDUP_WINDOW", 5*time.Second),
+
+		WSRecoverPanics: getBoolEnv("TMPEMAIL_WS_RECOVER_PANICS", true),
+
+		ForwardingEnabled:     getBoolEnv("TMPEMAIL_FORWARDING_ENABLED", false),
+		ForwardSMTPAddr:       getEnv("TMPEMAIL_FORWARD_SMTP_ADDR", ""),
+		ForwardFrom:           getEnv("TMPEMAIL_FORWARD_FROM", ""),
+		ForwardSMTPUsername:   getEnv("TMPEMAIL_FORWARD_SMTP_USERNAME", ""),
+		ForwardSMTPPassword:   getEnv("TMPEMAIL_FORWARD_SMTP_PASSWORD", ""),
+		ForwardRateLimit:      getIntEnv("TMPEMAIL_FORWARD_RATE_LIMIT", 5),
+		ForwardAllowedDomains: getEnvList("TMPEMAIL_FORWARD_ALLOWED_DOMAINS", nil),
+
+		OutboundTLSPolicy:     getEnv("TMPEMAIL_OUTBOUND_TLS_POLICY", "opportunistic"), // "opportunistic" or "required"
+		OutboundTLSMinVersion: getEnv("TMPEMAIL_OUTBOUND_TLS_MIN_VERSION", "1.2"),
+	}
+}
+
+// OutboundTLSVersion returns the crypto/tls version constant for OutboundTLSMinVersion
+func (c *Config) OutboundTLSVersion() (uint16, error) {
+	switch c.OutboundTLSMinVersion {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
 	}
+	return 0, fmt.Errorf("invalid outbound TLS version %q: use 1.0, 1.1, 1.2 or 1.3", c.OutboundTLSMinVersion)
+}
+
+// StoragePathFor returns the storage root for an address, chosen by its domain
+func (c *Config) StoragePathFor(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		if path, ok := c.DomainStoragePaths[strings.ToLower(address[i+1:])]; ok {
+			return path
+		}
+	}
+	return c.StoragePath
 }
 
 // getEnvList retrieves a comma-separated list from environment variable or returns default
@@ -73,6 +187,32 @@ func getEnvList(key string, defaultValue []string) []string {
 	return defaultValue
 }
 
+// getEnvMap retrieves a comma-separated list of key=value pairs from environment
+// variable or returns default. Keys are lowercased; malformed pairs are skipped.
+func getEnvMap(key string, defaultValue map[string]string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range getEnvList(key, nil) {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			continue
+		}
+		result[k] = v
+	}
+	if len(result) == 0 {
+		return defaultValue
+	}
+	return result
+}
+
+// getBoolEnv retrieves a bool environment variable or returns a default value
+func getBoolEnv(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		return value == "true" || value == "1" || value == "yes"
+	}
+	return defaultValue
+}
+
 // getEnv retrieves an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
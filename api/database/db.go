@@ -1,9 +1,12 @@
 package database
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"tmpemail_api/models"
@@ -16,6 +19,12 @@ import (
 //go:embed schema.sql
 var schemaFS embed.FS
 
+// ErrAddressExists is returned by InsertAddress when the address is already taken
+var ErrAddressExists = errors.New("address already exists")
+
+// ErrAttachmentIDCollision is returned when a generated attachment ID keeps colliding with an existing one
+var ErrAttachmentIDCollision = errors.New("attachment ID collision")
+
 // DB wraps the SQLx database connection
 type DB struct {
 	*sqlx.DB
@@ -45,16 +54,74 @@ func InitDB(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to execute schema: %w", err)
 	}
 
+	// Add columns introduced after the initial schema to existing databases
+	if err := migrateColumns(db); err != nil {
+		return nil, err
+	}
+
 	log.Println("Database initialized successfully")
 	return &DB{db}, nil
 }
 
+// columnMigration describes a column added to a table after its initial creation
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+	index      string // Optional index statement to run once the column exists
+}
+
+// columnMigrations lists columns added after the initial schema. CREATE TABLE IF NOT EXISTS
+// does not alter existing tables, so these are applied to databases that predate them.
+var columnMigrations = []columnMigration{
+	{table: "emails", column: "read_at", definition: "DATETIME"},
+	{table: "email_addresses", column: "block_remote_content", definition: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "email_addresses", column: "last_email_at", definition: "DATETIME"},
+	{table: "attachments", column: "disposition", definition: "TEXT NOT NULL DEFAULT 'attachment'"},
+	{table: "email_addresses", column: "session_token_hash", definition: "TEXT NOT NULL DEFAULT ''",
+		index: `CREATE INDEX IF NOT EXISTS idx_email_addresses_session_token_hash ON email_addresses(session_token_hash)`},
+	{table: "email_addresses", column: "forward_to", definition: "TEXT NOT NULL DEFAULT ''"},
+	{table: "attachments", column: "content_id", definition: "TEXT NOT NULL DEFAULT ''"},
+	{table: "attachments", column: "storage_tier", definition: "TEXT NOT NULL DEFAULT 'hot'"},
+}
+
+// migrateColumns adds any missing columns (and their indexes) from columnMigrations
+func migrateColumns(db *sqlx.DB) error {
+	for _, m := range columnMigrations {
+		var count int
+		query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+		if err := db.Get(&count, query, m.table, m.column); err != nil {
+			return fmt.Errorf("failed to inspect %s.%s: %w", m.table, m.column, err)
+		}
+		if count == 0 {
+			stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+			}
+		}
+		if m.index != "" {
+			if _, err := db.Exec(m.index); err != nil {
+				return fmt.Errorf("failed to create index for %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+	return nil
+}
+
 // InsertAddress inserts a new email address into the database
 func (db *DB) InsertAddress(addr *models.EmailAddress) error {
-	query := `INSERT INTO email_addresses (id, address, created_at, expires_at)
-	          VALUES (:id, :address, :created_at, :expires_at)`
-	_, err := db.NamedExec(query, addr)
+	return db.InsertAddressContext(context.Background(), addr)
+}
+
+// InsertAddressContext is InsertAddress with a context that can cancel the query
+func (db *DB) InsertAddressContext(ctx context.Context, addr *models.EmailAddress) error {
+	query := `INSERT INTO email_addresses (id, address, created_at, expires_at, block_remote_content, session_token_hash, forward_to)
+	          VALUES (:id, :address, :created_at, :expires_at, :block_remote_content, :session_token_hash, :forward_to)`
+	_, err := db.NamedExecContext(ctx, query, addr)
 	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: email_addresses.address") {
+			return ErrAddressExists
+		}
 		return fmt.Errorf("failed to insert address: %w", err)
 	}
 	return nil
@@ -62,9 +129,14 @@ func (db *DB) InsertAddress(addr *models.EmailAddress) error {
 
 // GetAddress retrieves an email address by its address string
 func (db *DB) GetAddress(address string) (*models.EmailAddress, error) {
+	return db.GetAddressContext(context.Background(), address)
+}
+
+// GetAddressContext is GetAddress with a context that can cancel the query
+func (db *DB) GetAddressContext(ctx context.Context, address string) (*models.EmailAddress, error) {
 	var addr models.EmailAddress
-	query := `SELECT id, address, created_at, expires_at FROM email_addresses WHERE address = ?`
-	err := db.Get(&addr, query, address)
+	query := `SELECT id, address, created_at, expires_at, block_remote_content, last_email_at, forward_to FROM email_addresses WHERE address = ?`
+	err := db.GetContext(ctx, &addr, query, address)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, nil
@@ -74,9 +146,88 @@ func (db *DB) GetAddress(address string) (*models.EmailAddress, error) {
 	return &addr, nil
 }
 
+// SetBlockRemoteContent updates the remote content blocking preference of an address
+func (db *DB) SetBlockRemoteContent(address string, block bool) error {
+	return db.SetBlockRemoteContentContext(context.Background(), address, block)
+}
+
+// SetBlockRemoteContentContext is SetBlockRemoteContent with a context that can cancel the query
+func (db *DB) SetBlockRemoteContentContext(ctx context.Context, address string, block bool) error {
+	query := `UPDATE email_addresses SET block_remote_content = ? WHERE address = ?`
+	_, err := db.ExecContext(ctx, query, block, address)
+	if err != nil {
+		return fmt.Errorf("failed to update remote content preference: %w", err)
+	}
+	return nil
+}
+
+// SessionAddress is an active address belonging to a client session
+type SessionAddress struct {
+	Address    string    `db:"address"`
+	CreatedAt  time.Time `db:"created_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+	EmailCount int       `db:"email_count"`
+}
+
+// GetActiveAddressesBySession returns the unexpired addresses generated by a session, newest first
+func (db *DB) GetActiveAddressesBySession(tokenHash string) ([]*SessionAddress, error) {
+	return db.GetActiveAddressesBySessionContext(context.Background(), tokenHash)
+}
+
+// GetActiveAddressesBySessionContext is GetActiveAddressesBySession with a context that can cancel the query
+func (db *DB) GetActiveAddressesBySessionContext(ctx context.Context, tokenHash string) ([]*SessionAddress, error) {
+	var addresses []*SessionAddress
+	query := `SELECT a.address, a.created_at, a.expires_at, COUNT(e.id) AS email_count
+	          FROM email_addresses a
+	          LEFT JOIN emails e ON e.to_address = a.address
+	          WHERE a.session_token_hash = ? AND a.expires_at > ?
+	          GROUP BY a.id
+	          ORDER BY a.created_at DESC`
+	err := db.SelectContext(ctx, &addresses, query, tokenHash, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session addresses: %w", err)
+	}
+	return addresses, nil
+}
+
+// SessionExists reports whether any address was generated by the session with this token hash
+func (db *DB) SessionExists(tokenHash string) (bool, error) {
+	return db.SessionExistsContext(context.Background(), tokenHash)
+}
+
+// SessionExistsContext is SessionExists with a context that can cancel the query
+func (db *DB) SessionExistsContext(ctx context.Context, tokenHash string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM email_addresses WHERE session_token_hash = ?)`
+	if err := db.GetContext(ctx, &exists, query, tokenHash); err != nil {
+		return false, fmt.Errorf("failed to look up session: %w", err)
+	}
+	return exists, nil
+}
+
+// TouchLastEmailAt records the time the most recent email was stored for an address
+func (db *DB) TouchLastEmailAt(address string, at time.Time) error {
+	return db.TouchLastEmailAtContext(context.Background(), address, at)
+}
+
+// TouchLastEmailAtContext is TouchLastEmailAt with a context that can cancel the query
+func (db *DB) TouchLastEmailAtContext(ctx context.Context, address string, at time.Time) error {
+	query := `UPDATE email_addresses SET last_email_at = ? WHERE address = ?`
+	_, err := db.ExecContext(ctx, query, at, address)
+	if err != nil {
+		return fmt.Errorf("failed to update last email time: %w", err)
+	}
+	return nil
+}
+
 // IsValidAddress checks if an address exists and is not expired
 func (db *DB) IsValidAddress(address string) (bool, bool, error) {
-	addr, err := db.GetAddress(address)
+	return db.IsValidAddressContext(context.Background(), address)
+}
+
+// IsValidAddressContext is IsValidAddress with a context that can cancel the query
+func (db *DB) IsValidAddressContext(ctx context.Context, address string) (bool, bool, error) {
+	addr, err := db.GetAddressContext(ctx, address)
 	if err != nil {
 		return false, false, err
 	}
@@ -89,33 +240,107 @@ func (db *DB) IsValidAddress(address string) (bool, bool, error) {
 
 // InsertEmail inserts a new email into the database
 func (db *DB) InsertEmail(email *models.Email) error {
+	return db.InsertEmailContext(context.Background(), email)
+}
+
+// InsertEmailContext is InsertEmail with a context that can cancel the query
+func (db *DB) InsertEmailContext(ctx context.Context, email *models.Email) error {
 	query := `INSERT INTO emails (id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at)
 	          VALUES (:id, :to_address, :from_address, :subject, :body_preview, :body_text, :body_html, :file_path, :received_at)`
-	_, err := db.NamedExec(query, email)
+	_, err := db.NamedExecContext(ctx, query, email)
 	if err != nil {
 		return fmt.Errorf("failed to insert email: %w", err)
 	}
 	return nil
 }
 
-// GetEmailsByAddress retrieves all emails for a given address, ordered by received_at DESC
-func (db *DB) GetEmailsByAddress(address string) ([]*models.Email, error) {
+// GetEmailsByAddress retrieves emails for a given address, ordered by received_at DESC.
+// At most limit emails are returned (0 = no limit).
+func (db *DB) GetEmailsByAddress(address string, limit int) ([]*models.Email, error) {
+	return db.GetEmailsByAddressContext(context.Background(), address, limit)
+}
+
+// GetEmailsByAddressContext is GetEmailsByAddress with a context that can cancel the query
+func (db *DB) GetEmailsByAddressContext(ctx context.Context, address string, limit int) ([]*models.Email, error) {
 	query := `SELECT id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at
 	          FROM emails WHERE to_address = ? ORDER BY received_at DESC`
+	args := []interface{}{address}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
 	var emails []*models.Email
-	err := db.Select(&emails, query, address)
+	err := db.SelectContext(ctx, &emails, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query emails: %w", err)
 	}
 	return emails, nil
 }
 
+// GetEmailsAfterID retrieves emails for an address whose ID sorts after afterID, oldest first.
+// IDs are ULIDs, so this returns exactly the emails stored after afterID.
+func (db *DB) GetEmailsAfterID(address, afterID string, limit int) ([]*models.Email, error) {
+	return db.GetEmailsAfterIDContext(context.Background(), address, afterID, limit)
+}
+
+// GetEmailsAfterIDContext is GetEmailsAfterID with a context that can cancel the query
+func (db *DB) GetEmailsAfterIDContext(ctx context.Context, address, afterID string, limit int) ([]*models.Email, error) {
+	query := `SELECT id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at
+	          FROM emails WHERE to_address = ? AND id > ? ORDER BY id ASC`
+	args := []interface{}{address, afterID}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	var emails []*models.Email
+	err := db.SelectContext(ctx, &emails, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query emails after id: %w", err)
+	}
+	return emails, nil
+}
+
+// CountEmailsByAddress returns the total number of emails for an address
+func (db *DB) CountEmailsByAddress(address string) (int, error) {
+	return db.CountEmailsByAddressContext(context.Background(), address)
+}
+
+// CountEmailsByAddressContext is CountEmailsByAddress with a context that can cancel the query
+func (db *DB) CountEmailsByAddressContext(ctx context.Context, address string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM emails WHERE to_address = ?`
+	if err := db.GetContext(ctx, &count, query, address); err != nil {
+		return 0, fmt.Errorf("failed to count emails: %w", err)
+	}
+	return count, nil
+}
+
+// CountUnreadEmailsByAddress returns the number of emails for an address that have not been marked as read
+func (db *DB) CountUnreadEmailsByAddress(address string) (int, error) {
+	return db.CountUnreadEmailsByAddressContext(context.Background(), address)
+}
+
+// CountUnreadEmailsByAddressContext is CountUnreadEmailsByAddress with a context that can cancel the query
+func (db *DB) CountUnreadEmailsByAddressContext(ctx context.Context, address string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM emails WHERE to_address = ? AND read_at IS NULL`
+	if err := db.GetContext(ctx, &count, query, address); err != nil {
+		return 0, fmt.Errorf("failed to count unread emails: %w", err)
+	}
+	return count, nil
+}
+
 // GetEmailByID retrieves a single email by its ID and address
 func (db *DB) GetEmailByID(address, emailID string) (*models.Email, error) {
+	return db.GetEmailByIDContext(context.Background(), address, emailID)
+}
+
+// GetEmailByIDContext is GetEmailByID with a context that can cancel the query
+func (db *DB) GetEmailByIDContext(ctx context.Context, address, emailID string) (*models.Email, error) {
 	var email models.Email
-	query := `SELECT id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at
+	query := `SELECT id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at, read_at
 	          FROM emails WHERE id = ? AND to_address = ?`
-	err := db.Get(&email, query, emailID, address)
+	err := db.GetContext(ctx, &email, query, emailID, address)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, nil
@@ -125,22 +350,96 @@ func (db *DB) GetEmailByID(address, emailID string) (*models.Email, error) {
 	return &email, nil
 }
 
+// MarkEmailRead sets read_at on an unread email; already-read emails keep their original read time.
+// It reports whether the email changed from unread to read.
+func (db *DB) MarkEmailRead(address, emailID string, at time.Time) (bool, error) {
+	return db.MarkEmailReadContext(context.Background(), address, emailID, at)
+}
+
+// MarkEmailReadContext is MarkEmailRead with a context that can cancel the query
+func (db *DB) MarkEmailReadContext(ctx context.Context, address, emailID string, at time.Time) (bool, error) {
+	query := `UPDATE emails SET read_at = ? WHERE id = ? AND to_address = ? AND read_at IS NULL`
+	result, err := db.ExecContext(ctx, query, at, emailID, address)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark email read: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark email read: %w", err)
+	}
+	return rows > 0, nil
+}
+
 // InsertAttachment inserts a new attachment into the database
 func (db *DB) InsertAttachment(att *models.Attachment) error {
-	query := `INSERT INTO attachments (id, email_id, filename, filepath, size)
-	          VALUES (:id, :email_id, :filename, :filepath, :size)`
-	_, err := db.NamedExec(query, att)
+	return db.InsertAttachmentContext(context.Background(), att)
+}
+
+// InsertAttachmentContext is InsertAttachment with a context that can cancel the query
+func (db *DB) InsertAttachmentContext(ctx context.Context, att *models.Attachment) error {
+	query := `INSERT INTO attachments (id, email_id, filename, filepath, size, disposition, content_id, storage_tier)
+	          VALUES (:id, :email_id, :filename, :filepath, :size, :disposition, :content_id, :storage_tier)`
+	_, err := db.NamedExecContext(ctx, query, att)
 	if err != nil {
 		return fmt.Errorf("failed to insert attachment: %w", err)
 	}
 	return nil
 }
 
+// maxAttachmentIDAttempts bounds how often a colliding attachment ID is regenerated
+const maxAttachmentIDAttempts = 3
+
+// InsertEmailWithAttachmentsContext inserts an email and its attachments in a single
+// transaction, so a failed attachment never leaves an email without its attachment rows.
+// A colliding attachment ID is regenerated; if it keeps colliding the whole insert is
+// rolled back and ErrAttachmentIDCollision is returned.
+func (db *DB) InsertEmailWithAttachmentsContext(ctx context.Context, email *models.Email, attachments []*models.Attachment) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO emails (id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at)
+	          VALUES (:id, :to_address, :from_address, :subject, :body_preview, :body_text, :body_html, :file_path, :received_at)`
+	if _, err := tx.NamedExecContext(ctx, query, email); err != nil {
+		return fmt.Errorf("failed to insert email: %w", err)
+	}
+
+	query = `INSERT INTO attachments (id, email_id, filename, filepath, size, disposition, content_id, storage_tier)
+	         VALUES (:id, :email_id, :filename, :filepath, :size, :disposition, :content_id, :storage_tier)`
+	for _, att := range attachments {
+		for attempt := 1; ; attempt++ {
+			_, err := tx.NamedExecContext(ctx, query, att)
+			if err == nil {
+				break
+			}
+			if !strings.Contains(err.Error(), "UNIQUE constraint failed: attachments.") {
+				return fmt.Errorf("failed to insert attachment: %w", err)
+			}
+			if attempt == maxAttachmentIDAttempts {
+				return fmt.Errorf("%w: %s", ErrAttachmentIDCollision, att.ID)
+			}
+			att.ID = models.NewAttachmentID()
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit email: %w", err)
+	}
+	return nil
+}
+
 // GetAttachmentsByEmailID retrieves all attachments for a given email
 func (db *DB) GetAttachmentsByEmailID(emailID string) ([]*models.Attachment, error) {
-	query := `SELECT id, email_id, filename, filepath, size FROM attachments WHERE email_id = ?`
+	return db.GetAttachmentsByEmailIDContext(context.Background(), emailID)
+}
+
+// GetAttachmentsByEmailIDContext is GetAttachmentsByEmailID with a context that can cancel the query
+func (db *DB) GetAttachmentsByEmailIDContext(ctx context.Context, emailID string) ([]*models.Attachment, error) {
+	query := `SELECT id, email_id, filename, filepath, size, disposition, content_id, storage_tier FROM attachments WHERE email_id = ?`
 	var attachments []*models.Attachment
-	err := db.Select(&attachments, query, emailID)
+	err := db.SelectContext(ctx, &attachments, query, emailID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query attachments: %w", err)
 	}
@@ -149,9 +448,14 @@ func (db *DB) GetAttachmentsByEmailID(emailID string) ([]*models.Attachment, err
 
 // GetAttachmentByID retrieves a single attachment by ID and email ID
 func (db *DB) GetAttachmentByID(emailID, attachmentID string) (*models.Attachment, error) {
+	return db.GetAttachmentByIDContext(context.Background(), emailID, attachmentID)
+}
+
+// GetAttachmentByIDContext is GetAttachmentByID with a context that can cancel the query
+func (db *DB) GetAttachmentByIDContext(ctx context.Context, emailID, attachmentID string) (*models.Attachment, error) {
 	var att models.Attachment
-	query := `SELECT id, email_id, filename, filepath, size FROM attachments WHERE id = ? AND email_id = ?`
-	err := db.Get(&att, query, attachmentID, emailID)
+	query := `SELECT id, email_id, filename, filepath, size, disposition, content_id, storage_tier FROM attachments WHERE id = ? AND email_id = ?`
+	err := db.GetContext(ctx, &att, query, attachmentID, emailID)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, nil
@@ -206,13 +510,40 @@ func (db *DB) GetAttachmentFilePathsByAddress(address string) ([]string, error)
 	return paths, nil
 }
 
+// CountOtherEmailFileReferences counts emails belonging to other addresses that reference the same .eml file
+func (db *DB) CountOtherEmailFileReferences(filePath, address string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM emails WHERE file_path = ? AND to_address != ?`
+	if err := db.Get(&count, query, filePath, address); err != nil {
+		return 0, fmt.Errorf("failed to count email file references: %w", err)
+	}
+	return count, nil
+}
+
+// CountOtherAttachmentFileReferences counts attachments of other addresses' emails that reference the same file
+func (db *DB) CountOtherAttachmentFileReferences(filePath, address string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM attachments a
+	          INNER JOIN emails e ON a.email_id = e.id
+	          WHERE a.filepath = ? AND e.to_address != ?`
+	if err := db.Get(&count, query, filePath, address); err != nil {
+		return 0, fmt.Errorf("failed to count attachment file references: %w", err)
+	}
+	return count, nil
+}
+
 // GetStorageUsedByAddress calculates total storage used by an email address in bytes
 // This includes email body sizes (text + html) and attachment sizes
 func (db *DB) GetStorageUsedByAddress(address string) (int64, error) {
+	return db.GetStorageUsedByAddressContext(context.Background(), address)
+}
+
+// GetStorageUsedByAddressContext is GetStorageUsedByAddress with a context that can cancel the query
+func (db *DB) GetStorageUsedByAddressContext(ctx context.Context, address string) (int64, error) {
 	// Sum of email body sizes
 	var emailSize int64
 	emailQuery := `SELECT COALESCE(SUM(LENGTH(body_text) + LENGTH(body_html)), 0) FROM emails WHERE to_address = ?`
-	err := db.Get(&emailSize, emailQuery, address)
+	err := db.GetContext(ctx, &emailSize, emailQuery, address)
 	if err != nil {
 		return 0, fmt.Errorf("failed to query email sizes: %w", err)
 	}
@@ -222,7 +553,7 @@ func (db *DB) GetStorageUsedByAddress(address string) (int64, error) {
 	attachmentQuery := `SELECT COALESCE(SUM(a.size), 0) FROM attachments a
 	                    INNER JOIN emails e ON a.email_id = e.id
 	                    WHERE e.to_address = ?`
-	err = db.Get(&attachmentSize, attachmentQuery, address)
+	err = db.GetContext(ctx, &attachmentSize, attachmentQuery, address)
 	if err != nil {
 		return 0, fmt.Errorf("failed to query attachment sizes: %w", err)
 	}
@@ -233,12 +564,21 @@ func (db *DB) GetStorageUsedByAddress(address string) (int64, error) {
 // EmailFilter represents filter criteria for email queries
 type EmailFilter struct {
 	FromAddress     string
+	FromDomain      string // Matches any sender at exactly this domain; must be a plain domain without wildcards
 	SubjectContains string
 	Since           *time.Time
+	Until           *time.Time
+	HasAttachments  *bool // nil = either
+	Limit           int   // Maximum number of emails to return (0 = no limit)
 }
 
 // GetEmailsByFilter retrieves emails for a given address with optional filters, ordered by received_at DESC
 func (db *DB) GetEmailsByFilter(address string, filter EmailFilter) ([]*models.Email, error) {
+	return db.GetEmailsByFilterContext(context.Background(), address, filter)
+}
+
+// GetEmailsByFilterContext is GetEmailsByFilter with a context that can cancel the query
+func (db *DB) GetEmailsByFilterContext(ctx context.Context, address string, filter EmailFilter) ([]*models.Email, error) {
 	query := `SELECT id, to_address, from_address, subject, body_preview, body_text, body_html, file_path, received_at
 	          FROM emails WHERE to_address = ?`
 
@@ -250,6 +590,13 @@ func (db *DB) GetEmailsByFilter(address string, filter EmailFilter) ([]*models.E
 		args = append(args, filter.FromAddress)
 	}
 
+	// Add sender domain filter if provided. from_address holds the raw From header, so
+	// also match the bracketed address of a "Name <user@domain>" sender.
+	if filter.FromDomain != "" {
+		query += " AND (from_address LIKE '%@' || ? OR from_address LIKE '%@' || ? || '>')"
+		args = append(args, filter.FromDomain, filter.FromDomain)
+	}
+
 	// Add subject filter if provided (case-insensitive LIKE)
 	if filter.SubjectContains != "" {
 		query += " AND subject LIKE ?"
@@ -262,10 +609,30 @@ func (db *DB) GetEmailsByFilter(address string, filter EmailFilter) ([]*models.E
 		args = append(args, filter.Since)
 	}
 
+	// Add until filter if provided
+	if filter.Until != nil {
+		query += " AND received_at <= ?"
+		args = append(args, filter.Until)
+	}
+
+	// Add attachment presence filter if provided
+	if filter.HasAttachments != nil {
+		if *filter.HasAttachments {
+			query += " AND EXISTS (SELECT 1 FROM attachments a WHERE a.email_id = emails.id)"
+		} else {
+			query += " AND NOT EXISTS (SELECT 1 FROM attachments a WHERE a.email_id = emails.id)"
+		}
+	}
+
 	query += " ORDER BY received_at DESC"
 
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
 	var emails []*models.Email
-	err := db.Select(&emails, query, args...)
+	err := db.SelectContext(ctx, &emails, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query emails with filters: %w", err)
 	}
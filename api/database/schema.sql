@@ -5,7 +5,11 @@ CREATE TABLE IF NOT EXISTS email_addresses (
     id TEXT PRIMARY KEY,
     address TEXT NOT NULL UNIQUE,
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    expires_at DATETIME NOT NULL
+    expires_at DATETIME NOT NULL,
+    block_remote_content INTEGER NOT NULL DEFAULT 0,
+    last_email_at DATETIME,
+    session_token_hash TEXT NOT NULL DEFAULT '',
+    forward_to TEXT NOT NULL DEFAULT ''
 );
 
 -- Emails table
@@ -19,6 +23,7 @@ CREATE TABLE IF NOT EXISTS emails (
     body_html TEXT NOT NULL DEFAULT '',
     file_path TEXT NOT NULL,
     received_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    read_at DATETIME,
     FOREIGN KEY (to_address) REFERENCES email_addresses(address) ON DELETE CASCADE
 );
 
@@ -29,6 +34,9 @@ CREATE TABLE IF NOT EXISTS attachments (
     filename TEXT NOT NULL,
     filepath TEXT NOT NULL,
     size INTEGER NOT NULL,
+    disposition TEXT NOT NULL DEFAULT 'attachment',
+    content_id TEXT NOT NULL DEFAULT '',
+    storage_tier TEXT NOT NULL DEFAULT 'hot',
     FOREIGN KEY (email_id) REFERENCES emails(id) ON DELETE CASCADE
 );
 
@@ -39,4 +47,8 @@ CREATE INDEX IF NOT EXISTS idx_emails_to_address ON emails(to_address);
 CREATE INDEX IF NOT EXISTS idx_emails_to_address_received_at ON emails(to_address, received_at DESC);
 CREATE INDEX IF NOT EXISTS idx_emails_from_address ON emails(from_address);
 CREATE INDEX IF NOT EXISTS idx_emails_received_at ON emails(received_at);
-CREATE INDEX IF NOT EXISTS idx_attachments_email_id ON attachments(email_id);
+-- Serves attachment lookups by email (and by email + ID); replaces idx_attachments_email_id
+CREATE UNIQUE INDEX IF NOT EXISTS idx_attachments_email_id_id ON attachments(email_id, id);
+DROP INDEX IF EXISTS idx_attachments_email_id;
+CREATE INDEX IF NOT EXISTS idx_emails_file_path ON emails(file_path);
+CREATE INDEX IF NOT EXISTS idx_attachments_filepath ON attachments(filepath);
@@ -0,0 +1,158 @@
+package forwarding
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"tmpemail_api/config"
+	"tmpemail_api/middleware"
+)
+
+// ForwardedHeader is added to every relayed message. Messages that already carry
+// it are never forwarded again, which breaks loops between forwarding services.
+const ForwardedHeader = "X-TmpEmail-Forwarded-For"
+
+const (
+	dialTimeout = 10 * time.Second
+	sendTimeout = 60 * time.Second
+)
+
+// Forwarder relays received messages to an address's forwarding target over an outbound SMTP relay
+type Forwarder struct {
+	smtpAddr    string
+	from        string
+	username    string
+	password    string
+	requireTLS  bool                    // Refuse to send when the relay does not offer STARTTLS
+	minTLS      uint16                  // Lowest TLS version accepted from the relay
+	rateLimiter *middleware.RateLimiter // Keyed by temp address
+	logger      *slog.Logger
+}
+
+// NewForwarder creates a forwarder from the forwarding configuration. An invalid
+// minimum TLS version falls back to TLS 1.2.
+func NewForwarder(cfg *config.Config, logger *slog.Logger) *Forwarder {
+	from := cfg.ForwardFrom
+	if from == "" {
+		from = "forwarder@" + cfg.EmailDomain
+	}
+	minTLS, err := cfg.OutboundTLSVersion()
+	if err != nil {
+		minTLS = tls.VersionTLS12
+	}
+
+	return &Forwarder{
+		smtpAddr:    cfg.ForwardSMTPAddr,
+		from:        from,
+		username:    cfg.ForwardSMTPUsername,
+		password:    cfg.ForwardSMTPPassword,
+		requireTLS:  cfg.OutboundTLSPolicy == "required",
+		minTLS:      minTLS,
+		rateLimiter: middleware.NewRateLimiterWithMaxIPs(cfg.ForwardRateLimit, "forward", cfg.RateLimitMaxIPs),
+		logger:      logger,
+	}
+}
+
+// Forward relays raw, received by address, to forwardTo in the background.
+// Automated messages, already forwarded messages and messages beyond the
+// per-address rate limit are dropped with a log line.
+func (f *Forwarder) Forward(address, forwardTo string, raw []byte, logger *slog.Logger) {
+	logger = logger.With("address", address, "forward_to", forwardTo)
+
+	if reason := skipReason(raw); reason != "" {
+		logger.Info("Not forwarding email", "reason", reason)
+		return
+	}
+	if !f.rateLimiter.Allow(address) {
+		logger.Warn("Forwarding rate limit exceeded, not forwarding email")
+		return
+	}
+
+	msg := make([]byte, 0, len(ForwardedHeader)+len(address)+4+len(raw))
+	msg = fmt.Appendf(msg, "%s: %s\r\n", ForwardedHeader, address)
+	msg = append(msg, raw...)
+
+	go func() {
+		if err := f.send(forwardTo, msg); err != nil {
+			logger.Error("Failed to forward email", "error", err)
+			return
+		}
+		logger.Info("Forwarded email")
+	}()
+}
+
+// skipReason returns why raw must not be forwarded, or "" if it may be
+func skipReason(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "unparseable headers"
+	}
+	if msg.Header.Get(ForwardedHeader) != "" {
+		return "already forwarded"
+	}
+	// Bounces, auto-replies and other machine-generated mail (RFC 3834)
+	if autoSubmitted := msg.Header.Get("Auto-Submitted"); autoSubmitted != "" && !strings.EqualFold(autoSubmitted, "no") {
+		return "auto-submitted"
+	}
+	return ""
+}
+
+// send delivers msg to forwardTo through the configured relay, upgrading to TLS when offered
+func (f *Forwarder) send(forwardTo string, msg []byte) error {
+	host, _, err := net.SplitHostPort(f.smtpAddr)
+	if err != nil {
+		return fmt.Errorf("invalid forwarding SMTP address %q: %w", f.smtpAddr, err)
+	}
+
+	conn, err := net.DialTimeout("tcp", f.smtpAddr, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", f.smtpAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer c.Close()
+
+	// A failed handshake always aborts; only a relay without STARTTLS can fall back to plaintext
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: f.minTLS}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	} else if f.requireTLS {
+		return fmt.Errorf("relay %s does not offer STARTTLS, refusing to forward in plaintext", f.smtpAddr)
+	}
+	if f.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", f.username, f.password, host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(f.from); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %w", err)
+	}
+	if err := c.Rcpt(forwardTo); err != nil {
+		return fmt.Errorf("RCPT TO rejected: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA rejected: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message rejected: %w", err)
+	}
+	return c.Quit()
+}
@@ -2,8 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 
 	"tmpemail_api/config"
 	"tmpemail_api/database"
@@ -12,24 +20,80 @@ import (
 
 // AddressHandler handles email address generation
 type AddressHandler struct {
-	db     *database.DB
-	config *config.Config
-	logger *slog.Logger
+	db        *database.DB
+	config    *config.Config
+	logger    *slog.Logger
+	generator models.AddressGenerator
 }
 
 // NewAddressHandler creates a new address handler
 func NewAddressHandler(db *database.DB, cfg *config.Config, logger *slog.Logger) *AddressHandler {
+	generator, err := models.NewAddressGenerator(cfg.AddressStyle, cfg.PassphraseWords)
+	if err != nil {
+		logger.Warn("Invalid address generation settings, using readable addresses", "error", err)
+		generator = models.GenerateEmailAddress
+	}
+
 	return &AddressHandler{
-		db:     db,
-		config: cfg,
-		logger: logger,
+		db:        db,
+		config:    cfg,
+		logger:    logger,
+		generator: generator,
 	}
 }
 
+// maxGenerateAttempts bounds retries when a generated address is already taken
+const maxGenerateAttempts = 5
+
+// SessionTokenHeader identifies the client session that generated an address
+const SessionTokenHeader = "X-Session-Token"
+
 // GenerateResponse represents the response for email address generation
 type GenerateResponse struct {
-	Address   string `json:"address"`
-	ExpiresAt string `json:"expires_at"`
+	Address            string `json:"address"`
+	ExpiresAt          string `json:"expires_at"`
+	BlockRemoteContent bool   `json:"block_remote_content"`
+	SessionToken       string `json:"session_token"` // Send back as X-Session-Token to link further addresses to this session
+	ServerTime         string `json:"server_time"`   // Lets clients compute remaining TTL without trusting their own clock
+	ForwardTo          string `json:"forward_to,omitempty"`
+}
+
+// SessionAddressInfo describes one active address of a session
+type SessionAddressInfo struct {
+	Address    string `json:"address"`
+	CreatedAt  string `json:"created_at"`
+	ExpiresAt  string `json:"expires_at"`
+	EmailCount int    `json:"email_count"`
+}
+
+// SessionAddressesResponse represents the response for listing a session's addresses
+type SessionAddressesResponse struct {
+	Addresses []SessionAddressInfo `json:"addresses"`
+}
+
+// PreferencesRequest represents the request to update address preferences
+type PreferencesRequest struct {
+	BlockRemoteContent *bool `json:"block_remote_content"`
+}
+
+// PreferencesResponse represents the current preferences of an address
+type PreferencesResponse struct {
+	Address            string `json:"address"`
+	BlockRemoteContent bool   `json:"block_remote_content"`
+}
+
+// StatusResponse represents the current state of an address
+type StatusResponse struct {
+	Address      string  `json:"address"`
+	CreatedAt    string  `json:"created_at"`
+	ExpiresAt    string  `json:"expires_at"`
+	Expired      bool    `json:"expired"`
+	EmailCount   int     `json:"email_count"`
+	LastEmailAt  *string `json:"last_email_at"` // null until the first email arrives
+	StorageUsed  int64   `json:"storage_used"`
+	StorageQuota int64   `json:"storage_quota"` // 0 = unlimited
+	QuotaWarning bool    `json:"quota_warning"` // Usage is close to the quota; mail beyond it is dropped
+	ServerTime   string  `json:"server_time"`
 }
 
 // Generate handles POST /api/generate - generates a new temporary email address
@@ -40,15 +104,77 @@ func (h *AddressHandler) Generate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate new email address
-	emailAddr, err := models.NewEmailAddress(h.config.EmailDomain, h.config.DefaultExpiration)
+	emailAddr, err := models.NewEmailAddressWithGenerator(h.config.EmailDomain, h.config.DefaultExpiration, h.generator)
 	if err != nil {
 		h.logger.Error("Failed to generate email address", "error", err)
 		http.Error(w, "Failed to generate email address", http.StatusInternalServerError)
 		return
 	}
 
-	// Insert into database
-	if err := h.db.InsertAddress(emailAddr); err != nil {
+	// Optional remote content blocking preference (block_remote_content=true)
+	if block := r.URL.Query().Get("block_remote_content"); block != "" {
+		blockRemote, err := strconv.ParseBool(block)
+		if err != nil {
+			http.Error(w, "Invalid block_remote_content parameter. Use true or false", http.StatusBadRequest)
+			return
+		}
+		emailAddr.BlockRemoteContent = blockRemote
+	}
+
+	// Optional forwarding target (forward_to=user@example.com), only when the operator enabled forwarding
+	if forwardTo := r.URL.Query().Get("forward_to"); forwardTo != "" {
+		if !h.config.ForwardingEnabled {
+			http.Error(w, "Forwarding is not enabled on this server", http.StatusBadRequest)
+			return
+		}
+		target, err := parseForwardTarget(forwardTo, h.config.EmailDomain, h.config.ForwardAllowedDomains)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		emailAddr.ForwardTo = target
+	}
+
+	// Link the address to the caller's session. Only tokens this server issued are
+	// honoured; anything else starts a new session, so a client cannot pick a token
+	// and attach its addresses to a session it guessed or was handed.
+	sessionToken := r.Header.Get(SessionTokenHeader)
+	if sessionToken != "" {
+		known := false
+		if models.ValidSessionTokenFormat(sessionToken) {
+			known, err = h.db.SessionExistsContext(r.Context(), models.HashSessionToken(sessionToken))
+			if err != nil {
+				h.logger.Error("Failed to look up session", "error", err)
+				http.Error(w, "Failed to generate email address", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !known {
+			sessionToken = ""
+		}
+	}
+	if sessionToken == "" {
+		sessionToken, err = models.NewSessionToken()
+		if err != nil {
+			h.logger.Error("Failed to generate session token", "error", err)
+			http.Error(w, "Failed to generate email address", http.StatusInternalServerError)
+			return
+		}
+	}
+	emailAddr.SessionTokenHash = models.HashSessionToken(sessionToken)
+
+	// Insert into database, picking a new address if the generated one is taken
+	for attempt := 1; ; attempt++ {
+		err = h.db.InsertAddressContext(r.Context(), emailAddr)
+		if !errors.Is(err, database.ErrAddressExists) || attempt == maxGenerateAttempts {
+			break
+		}
+		h.logger.Warn("Generated address already exists, retrying", "address", emailAddr.Address, "attempt", attempt)
+		if emailAddr.Address, err = h.generator(h.config.EmailDomain); err != nil {
+			break
+		}
+	}
+	if err != nil {
 		h.logger.Error("Failed to insert address into database", "error", err, "address", emailAddr.Address)
 		http.Error(w, "Failed to save email address", http.StatusInternalServerError)
 		return
@@ -58,11 +184,194 @@ func (h *AddressHandler) Generate(w http.ResponseWriter, r *http.Request) {
 
 	// Return response
 	response := GenerateResponse{
-		Address:   emailAddr.Address,
-		ExpiresAt: emailAddr.ExpiresAt.Format("2006-01-02T15:04:05Z07:00"),
+		Address:            emailAddr.Address,
+		ExpiresAt:          emailAddr.ExpiresAt.UTC().Format(time.RFC3339),
+		BlockRemoteContent: emailAddr.BlockRemoteContent,
+		SessionToken:       sessionToken,
+		ServerTime:         serverTime(),
+		ForwardTo:          emailAddr.ForwardTo,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
+
+// UpdatePreferences handles PUT /api/v1/address/{address}/preferences - updates per-address preferences
+func (h *AddressHandler) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
+
+	addr, err := h.db.GetAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to get address", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if addr == nil {
+		http.Error(w, "Email address not found", http.StatusNotFound)
+		return
+	}
+
+	if addr.IsExpired() {
+		http.Error(w, "Email address has expired", http.StatusGone)
+		return
+	}
+
+	var req PreferencesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.BlockRemoteContent != nil {
+		if err := h.db.SetBlockRemoteContentContext(r.Context(), address, *req.BlockRemoteContent); err != nil {
+			h.logger.Error("Failed to update preferences", "error", err, "address", address)
+			http.Error(w, "Failed to update preferences", http.StatusInternalServerError)
+			return
+		}
+		addr.BlockRemoteContent = *req.BlockRemoteContent
+	}
+
+	h.logger.Info("Updated address preferences", "address", address, "block_remote_content", addr.BlockRemoteContent)
+
+	response := PreferencesResponse{
+		Address:            addr.Address,
+		BlockRemoteContent: addr.BlockRemoteContent,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetStatus handles GET /api/v1/address/{address}/status - returns expiry and activity information for an address
+func (h *AddressHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
+
+	addr, err := h.db.GetAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to get address", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if addr == nil {
+		http.Error(w, "Email address not found", http.StatusNotFound)
+		return
+	}
+
+	emailCount, err := h.db.CountEmailsByAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to count emails", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	storageUsed, err := h.db.GetStorageUsedByAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to get storage used", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := StatusResponse{
+		Address:      addr.Address,
+		CreatedAt:    addr.CreatedAt.UTC().Format(time.RFC3339),
+		ExpiresAt:    addr.ExpiresAt.UTC().Format(time.RFC3339),
+		Expired:      addr.IsExpired(),
+		EmailCount:   emailCount,
+		StorageUsed:  storageUsed,
+		StorageQuota: h.config.StorageQuotaPerAddress,
+		QuotaWarning: quotaWarning(storageUsed, h.config.StorageQuotaPerAddress, h.config.QuotaWarningPercent),
+		ServerTime:   serverTime(),
+	}
+	if addr.LastEmailAt != nil {
+		lastEmailAt := addr.LastEmailAt.UTC().Format(time.RFC3339)
+		response.LastEmailAt = &lastEmailAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListSessionAddresses handles GET /api/v1/addresses - lists the active addresses generated by the caller's session
+func (h *AddressHandler) ListSessionAddresses(w http.ResponseWriter, r *http.Request) {
+	sessionToken := r.Header.Get(SessionTokenHeader)
+	if !models.ValidSessionTokenFormat(sessionToken) {
+		http.Error(w, "Missing or invalid session token", http.StatusUnauthorized)
+		return
+	}
+
+	addresses, err := h.db.GetActiveAddressesBySessionContext(r.Context(), models.HashSessionToken(sessionToken))
+	if err != nil {
+		h.logger.Error("Failed to list session addresses", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := SessionAddressesResponse{Addresses: make([]SessionAddressInfo, 0, len(addresses))}
+	for _, addr := range addresses {
+		response.Addresses = append(response.Addresses, SessionAddressInfo{
+			Address:    addr.Address,
+			CreatedAt:  addr.CreatedAt.UTC().Format(time.RFC3339),
+			ExpiresAt:  addr.ExpiresAt.UTC().Format(time.RFC3339),
+			EmailCount: addr.EmailCount,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseForwardTarget validates a forward_to parameter and returns the bare address.
+// Targets on the service's own domain are refused so forwarding cannot loop, and only
+// domains the operator allowed are accepted so anonymous callers cannot turn the
+// service into a relay towards arbitrary mailboxes.
+func parseForwardTarget(forwardTo, emailDomain string, allowedDomains []string) (string, error) {
+	parsed, err := mail.ParseAddress(forwardTo)
+	if err != nil || parsed.Name != "" {
+		return "", errors.New("Invalid forward_to parameter. Use a plain email address")
+	}
+	if strings.EqualFold(parsed.Address[strings.LastIndex(parsed.Address, "@")+1:], emailDomain) {
+		return "", errors.New("Cannot forward to an address on this service")
+	}
+	if !forwardTargetAllowed(parsed.Address, allowedDomains) {
+		return "", errors.New("Forwarding to this domain is not allowed")
+	}
+	return parsed.Address, nil
+}
+
+// forwardTargetAllowed reports whether target is on one of the allowed domains
+func forwardTargetAllowed(target string, allowedDomains []string) bool {
+	domain := target[strings.LastIndex(target, "@")+1:]
+	return slices.ContainsFunc(allowedDomains, func(allowed string) bool {
+		return strings.EqualFold(allowed, domain)
+	})
+}
+
+// serverTime returns the current server time in UTC RFC3339, the format used
+// for every timestamp clients compare against it
+func serverTime() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// validAddressParam checks an {address} parameter, writing a 400 and returning false
+// when it is missing or, with format validation enabled, malformed. Rejecting garbage
+// here spares the database lookups of scanners probing random paths.
+func validAddressParam(w http.ResponseWriter, address string, cfg *config.Config) bool {
+	if address == "" {
+		http.Error(w, "Missing address parameter", http.StatusBadRequest)
+		return false
+	}
+	if cfg.ValidateAddressFormat && !models.ValidAddressFormat(address, cfg.MaxAddressLength) {
+		http.Error(w, "Invalid address format", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
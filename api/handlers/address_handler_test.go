@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tmpemail_api/config"
+	"tmpemail_api/database"
+	"tmpemail_api/models"
+)
+
+// newTestAddressHandler returns an address handler on a fresh database
+func newTestAddressHandler(t *testing.T, configure func(cfg *config.Config)) *AddressHandler {
+	t.Helper()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := &config.Config{
+		EmailDomain:       "tmpemail.xyz",
+		DefaultExpiration: time.Hour,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	return NewAddressHandler(db, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// generate calls Generate with the given query and session token and decodes the response
+func generate(t *testing.T, h *AddressHandler, query, sessionToken string) (int, GenerateResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/generate?"+query, nil)
+	if sessionToken != "" {
+		req.Header.Set(SessionTokenHeader, sessionToken)
+	}
+	rec := httptest.NewRecorder()
+	h.Generate(rec, req)
+
+	var resp GenerateResponse
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode generate response: %v", err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestGenerateOnlyReusesIssuedSessionTokens(t *testing.T) {
+	h := newTestAddressHandler(t, nil)
+
+	_, first := generate(t, h, "", "")
+	if !models.ValidSessionTokenFormat(first.SessionToken) {
+		t.Fatalf("issued session token %q has an unexpected format", first.SessionToken)
+	}
+	if _, again := generate(t, h, "", first.SessionToken); again.SessionToken != first.SessionToken {
+		t.Errorf("issued token was not reused: got %q, want %q", again.SessionToken, first.SessionToken)
+	}
+
+	unknown, err := models.NewSessionToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"never issued": unknown,
+		"chosen":       "my-session",
+		"uppercase":    "A" + first.SessionToken[1:],
+	} {
+		t.Run(name, func(t *testing.T) {
+			code, resp := generate(t, h, "", token)
+			if code != http.StatusOK {
+				t.Fatalf("Generate status = %d, want 200", code)
+			}
+			if resp.SessionToken == token || resp.SessionToken == first.SessionToken {
+				t.Errorf("Generate kept session token %q, want a newly issued one", resp.SessionToken)
+			}
+		})
+	}
+}
+
+func TestGenerateForwardTargetMustBeAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		target  string
+		want    int
+	}{
+		{name: "no allowlist", allowed: nil, target: "me@example.com", want: http.StatusBadRequest},
+		{name: "allowed domain", allowed: []string{"example.com"}, target: "me@example.com", want: http.StatusOK},
+		{name: "allowed domain is case-insensitive", allowed: []string{"Example.com"}, target: "me@EXAMPLE.com", want: http.StatusOK},
+		{name: "other domain", allowed: []string{"example.com"}, target: "me@elsewhere.org", want: http.StatusBadRequest},
+		{name: "subdomain is not allowed", allowed: []string{"example.com"}, target: "me@mail.example.com", want: http.StatusBadRequest},
+		{name: "own domain", allowed: []string{"tmpemail.xyz"}, target: "me@tmpemail.xyz", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestAddressHandler(t, func(cfg *config.Config) {
+				cfg.ForwardingEnabled = true
+				cfg.ForwardAllowedDomains = tt.allowed
+			})
+
+			code, resp := generate(t, h, "forward_to="+tt.target, "")
+			if code != tt.want {
+				t.Fatalf("Generate(forward_to=%s) status = %d, want %d", tt.target, code, tt.want)
+			}
+			if code == http.StatusOK && resp.ForwardTo != tt.target {
+				t.Errorf("ForwardTo = %q, want %q", resp.ForwardTo, tt.target)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jhillyerd/enmime"
+
+	"tmpemail_api/config"
+	"tmpemail_api/database"
+	"tmpemail_api/models"
+	"tmpemail_api/storage"
+)
+
+// AdminHandler handles operator endpoints for inspecting any address.
+// Unlike the public endpoints these skip expiry checks and never change read state.
+type AdminHandler struct {
+	db     *database.DB
+	config *config.Config
+	logger *slog.Logger
+	store  *storage.Store
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(db *database.DB, cfg *config.Config, logger *slog.Logger, store *storage.Store) *AdminHandler {
+	return &AdminHandler{
+		db:     db,
+		config: cfg,
+		logger: logger,
+		store:  store,
+	}
+}
+
+// AdminAddressResponse represents the full state of an address for operators
+type AdminAddressResponse struct {
+	*models.EmailAddress
+	Expired      bool  `json:"expired"`
+	EmailCount   int   `json:"email_count"`
+	StorageUsed  int64 `json:"storage_used"`
+	StorageQuota int64 `json:"storage_quota"`
+}
+
+// AdminEmailResponse represents a stored email as-is, including unsanitized HTML and file paths
+type AdminEmailResponse struct {
+	Email       *models.Email        `json:"email"`
+	Attachments []*models.Attachment `json:"attachments"`
+}
+
+// MIMEPartInfo describes one node of a reparsed message's MIME tree
+type MIMEPartInfo struct {
+	PartID      string            `json:"part_id"`
+	ContentType string            `json:"content_type"`
+	Params      map[string]string `json:"params,omitempty"`
+	Disposition string            `json:"disposition,omitempty"`
+	FileName    string            `json:"filename,omitempty"`
+	ContentID   string            `json:"content_id,omitempty"`
+	Charset     string            `json:"charset,omitempty"`
+	Size        int               `json:"size"` // Decoded content bytes
+	Errors      []string          `json:"errors,omitempty"`
+	Children    []*MIMEPartInfo   `json:"children,omitempty"`
+}
+
+// MIMEDebugResponse is the MIME structure of a stored .eml file as enmime parses it
+type MIMEDebugResponse struct {
+	EmailID  string        `json:"email_id"`
+	FilePath string        `json:"file_path"`
+	Size     int           `json:"size"` // Raw .eml bytes
+	Root     *MIMEPartInfo `json:"root"`
+}
+
+// getAddress loads an address regardless of expiry, writing an error response when it cannot be returned
+func (ah *AdminHandler) getAddress(w http.ResponseWriter, r *http.Request, address string) *models.EmailAddress {
+	if !validAddressParam(w, address, ah.config) {
+		return nil
+	}
+	addr, err := ah.db.GetAddressContext(r.Context(), address)
+	if err != nil {
+		ah.logger.Error("Failed to get address", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil
+	}
+	if addr == nil {
+		http.Error(w, "Email address not found", http.StatusNotFound)
+		return nil
+	}
+	return addr
+}
+
+// GetAddress handles GET /internal/v1/admin/address/{address} - returns an address with its usage
+func (ah *AdminHandler) GetAddress(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	addr := ah.getAddress(w, r, address)
+	if addr == nil {
+		return
+	}
+
+	emailCount, err := ah.db.CountEmailsByAddressContext(r.Context(), address)
+	if err != nil {
+		ah.logger.Error("Failed to count emails", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	storageUsed, err := ah.db.GetStorageUsedByAddressContext(r.Context(), address)
+	if err != nil {
+		ah.logger.Error("Failed to get storage used", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := AdminAddressResponse{
+		EmailAddress: addr,
+		Expired:      addr.IsExpired(),
+		EmailCount:   emailCount,
+		StorageUsed:  storageUsed,
+		StorageQuota: ah.config.StorageQuotaPerAddress,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetEmails handles GET /internal/v1/admin/emails/{address} - lists every email of an address
+func (ah *AdminHandler) GetEmails(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	if ah.getAddress(w, r, address) == nil {
+		return
+	}
+
+	emails, err := ah.db.GetEmailsByAddressContext(r.Context(), address, 0)
+	if err != nil {
+		ah.logger.Error("Failed to get emails", "error", err, "address", address)
+		http.Error(w, "Failed to retrieve emails", http.StatusInternalServerError)
+		return
+	}
+
+	summaries := make([]EmailSummary, 0, len(emails))
+	for _, email := range emails {
+		attachments, _ := ah.db.GetAttachmentsByEmailIDContext(r.Context(), email.ID)
+		summaries = append(summaries, EmailSummary{
+			ID:             email.ID,
+			From:           email.FromAddress,
+			Subject:        email.Subject,
+			Preview:        email.BodyPreview,
+			ReceivedAt:     email.ReceivedAt.Format("2006-01-02T15:04:05Z07:00"),
+			HasAttachments: len(attachments) > 0,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EmailListResponse{Emails: summaries})
+}
+
+// GetEmail handles GET /internal/v1/admin/email/{address}/{emailID} - returns a stored email with its attachments
+func (ah *AdminHandler) GetEmail(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	emailID := chi.URLParam(r, "emailID")
+	if ah.getAddress(w, r, address) == nil {
+		return
+	}
+
+	email, err := ah.db.GetEmailByIDContext(r.Context(), address, emailID)
+	if err != nil {
+		ah.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
+		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
+		return
+	}
+	if email == nil {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	attachments, err := ah.db.GetAttachmentsByEmailIDContext(r.Context(), emailID)
+	if err != nil {
+		ah.logger.Error("Failed to get attachments", "error", err, "email_id", emailID)
+		http.Error(w, "Failed to retrieve attachments", http.StatusInternalServerError)
+		return
+	}
+	if attachments == nil {
+		attachments = []*models.Attachment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdminEmailResponse{Email: email, Attachments: attachments})
+}
+
+// DownloadAttachment handles GET /internal/v1/admin/email/{address}/{emailID}/attachments/{attachmentID}
+func (ah *AdminHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	emailID := chi.URLParam(r, "emailID")
+	attachmentID := chi.URLParam(r, "attachmentID")
+	if ah.getAddress(w, r, address) == nil {
+		return
+	}
+
+	email, err := ah.db.GetEmailByIDContext(r.Context(), address, emailID)
+	if err != nil {
+		ah.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
+		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
+		return
+	}
+	if email == nil {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	attachment, err := ah.db.GetAttachmentByIDContext(r.Context(), emailID, attachmentID)
+	if err != nil {
+		ah.logger.Error("Failed to get attachment", "error", err, "email_id", emailID, "attachment_id", attachmentID)
+		http.Error(w, "Failed to retrieve attachment", http.StatusInternalServerError)
+		return
+	}
+	if attachment == nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	serveAttachment(w, ah.store, ah.logger, attachment)
+}
+
+// MIMEDebug handles GET /internal/v1/email/{address}/{emailID}/mime-debug - reparses
+// the stored .eml and returns its MIME tree for diagnosing parsing problems
+func (ah *AdminHandler) MIMEDebug(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	emailID := chi.URLParam(r, "emailID")
+	if ah.getAddress(w, r, address) == nil {
+		return
+	}
+
+	email, err := ah.db.GetEmailByIDContext(r.Context(), address, emailID)
+	if err != nil {
+		ah.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
+		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
+		return
+	}
+	if email == nil {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	raw, err := ah.store.ReadFile(email.FilePath)
+	if err != nil {
+		ah.logger.Error("Failed to read email file", "error", err, "email_id", emailID, "path", email.FilePath)
+		http.Error(w, "Failed to read email file", http.StatusInternalServerError)
+		return
+	}
+
+	root, err := enmime.ReadParts(bytes.NewReader(raw))
+	if err != nil {
+		ah.logger.Error("Failed to parse email file", "error", err, "email_id", emailID, "path", email.FilePath)
+		http.Error(w, "Failed to parse email: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	response := MIMEDebugResponse{
+		EmailID:  emailID,
+		FilePath: email.FilePath,
+		Size:     len(raw),
+		Root:     mimePartInfo(root),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// mimePartInfo converts an enmime part and its descendants
+func mimePartInfo(part *enmime.Part) *MIMEPartInfo {
+	info := &MIMEPartInfo{
+		PartID:      part.PartID,
+		ContentType: part.ContentType,
+		Params:      part.ContentTypeParams,
+		Disposition: part.Disposition,
+		FileName:    part.FileName,
+		ContentID:   part.ContentID,
+		Charset:     part.Charset,
+		Size:        len(part.Content),
+	}
+	for _, e := range part.Errors {
+		info.Errors = append(info.Errors, e.String())
+	}
+	for child := part.FirstChild; child != nil; child = child.NextSibling {
+		info.Children = append(info.Children, mimePartInfo(child))
+	}
+	return info
+}
+
+// maxPreviewCount bounds the samples returned by a generate preview
+const maxPreviewCount = 20
+
+// previewPrefix restricts preview prefixes to what is valid at the start of a local part
+var previewPrefix = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
+
+// GeneratePreviewResponse lists sample addresses for a generation format without persisting them
+type GeneratePreviewResponse struct {
+	Format    string                   `json:"format"`
+	Words     int                      `json:"words,omitempty"` // Passphrase format only
+	Prefix    string                   `json:"prefix,omitempty"`
+	Addresses []GeneratePreviewAddress `json:"addresses"`
+}
+
+// GeneratePreviewAddress is one sample address and whether the public endpoints would accept it
+type GeneratePreviewAddress struct {
+	Address     string `json:"address"`
+	ValidFormat bool   `json:"valid_format"`
+}
+
+// GeneratePreview handles GET /internal/v1/generate/preview - generates sample addresses for
+// ?format= (readable or passphrase, default TMPEMAIL_ADDRESS_STYLE), ?words=, ?prefix= and
+// ?count= (1-20) so generation changes can be checked before they are deployed
+func (ah *AdminHandler) GeneratePreview(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = ah.config.AddressStyle
+	}
+
+	words := ah.config.PassphraseWords
+	if wordsParam := query.Get("words"); wordsParam != "" {
+		parsed, err := strconv.Atoi(wordsParam)
+		if err != nil || parsed < 2 || parsed > 10 {
+			http.Error(w, "Invalid words parameter. Use a number between 2 and 10", http.StatusBadRequest)
+			return
+		}
+		words = parsed
+	}
+
+	count := 1
+	if countParam := query.Get("count"); countParam != "" {
+		parsed, err := strconv.Atoi(countParam)
+		if err != nil || parsed < 1 || parsed > maxPreviewCount {
+			http.Error(w, fmt.Sprintf("Invalid count parameter. Use a number between 1 and %d", maxPreviewCount), http.StatusBadRequest)
+			return
+		}
+		count = parsed
+	}
+
+	prefix := strings.ToLower(query.Get("prefix"))
+	if prefix != "" && !previewPrefix.MatchString(prefix) {
+		http.Error(w, "Invalid prefix parameter. Use up to 32 letters, digits and inner hyphens", http.StatusBadRequest)
+		return
+	}
+
+	generator, err := models.NewAddressGenerator(format, words)
+	if err != nil {
+		http.Error(w, "Invalid format parameter. Use readable or passphrase", http.StatusBadRequest)
+		return
+	}
+	generator = models.WithPrefix(generator, prefix)
+
+	response := GeneratePreviewResponse{
+		Format:    format,
+		Prefix:    prefix,
+		Addresses: make([]GeneratePreviewAddress, 0, count),
+	}
+	if format == "passphrase" {
+		response.Words = words
+	}
+	for range count {
+		address, err := generator(ah.config.EmailDomain)
+		if err != nil {
+			ah.logger.Error("Failed to generate preview address", "error", err, "format", format)
+			http.Error(w, "Failed to generate address", http.StatusInternalServerError)
+			return
+		}
+		response.Addresses = append(response.Addresses, GeneratePreviewAddress{
+			Address:     address,
+			ValidFormat: models.ValidAddressFormat(address, ah.config.MaxAddressLength),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
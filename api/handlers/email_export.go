@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"tmpemail_api/models"
+)
+
+// cidReference matches cid: URLs in an HTML body, capturing the Content-ID
+var cidReference = regexp.MustCompile(`(?i)cid:([^"'\s<>)]+)`)
+
+// embeddableImageTypes are the content types the export sanitizer accepts as data URIs
+var embeddableImageTypes = map[string]bool{
+	"image/gif":     true,
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/svg+xml": true,
+	"image/webp":    true,
+}
+
+// exportTemplate is the standalone document an exported email is rendered into
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Subject}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.headers { border-bottom: 1px solid #ccc; margin: 0 0 1em; padding-bottom: 1em; }
+.headers dt { float: left; clear: left; width: 5em; font-weight: bold; }
+.headers dd { margin-left: 5em; }
+pre { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<dl class="headers">
+<dt>From</dt><dd>{{.From}}</dd>
+<dt>To</dt><dd>{{.To}}</dd>
+<dt>Subject</dt><dd>{{.Subject}}</dd>
+<dt>Date</dt><dd>{{.ReceivedAt}}</dd>
+</dl>
+{{if .BodyHTML}}<div class="body">{{.BodyHTML}}</div>{{else}}<pre>{{.BodyText}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// exportDocument is the data rendered by exportTemplate
+type exportDocument struct {
+	From       string
+	To         string
+	Subject    string
+	ReceivedAt string
+	BodyHTML   template.HTML // Already sanitized
+	BodyText   string
+}
+
+// ExportHTML handles GET /api/v1/email/{address}/{emailID}/export.html - downloads the email as a
+// self-contained HTML file with its inline images embedded as data URIs
+func (h *EmailHandler) ExportHTML(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	emailID := chi.URLParam(r, "emailID")
+
+	if address == "" || emailID == "" {
+		http.Error(w, "Missing address or email ID parameter", http.StatusBadRequest)
+		return
+	}
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
+
+	// Validate address (the address record also carries display preferences)
+	addr, err := h.db.GetAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to validate address", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if addr == nil {
+		http.Error(w, "Email address not found", http.StatusNotFound)
+		return
+	}
+
+	if addr.IsExpired() {
+		http.Error(w, "Email address has expired", http.StatusGone)
+		return
+	}
+
+	blockRemote, err := blockRemoteContent(r, addr)
+	if err != nil {
+		http.Error(w, "Invalid block_remote_content parameter. Use true or false", http.StatusBadRequest)
+		return
+	}
+
+	email, err := h.db.GetEmailByIDContext(r.Context(), address, emailID)
+	if err != nil {
+		h.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
+		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
+		return
+	}
+
+	if email == nil {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	doc := exportDocument{
+		From:       email.FromAddress,
+		To:         email.ToAddress,
+		Subject:    email.Subject,
+		ReceivedAt: email.ReceivedAt.UTC().Format(time.RFC3339),
+		BodyText:   email.BodyText,
+	}
+
+	if email.BodyHTML != "" {
+		attachments, err := h.db.GetAttachmentsByEmailIDContext(r.Context(), emailID)
+		if err != nil {
+			h.logger.Warn("Failed to get attachments", "error", err, "email_id", emailID)
+			// Export without inline images on error
+		}
+
+		// Data URIs are embedded before sanitizing so the export policy validates them too
+		sanitizer := h.exportSanitizer
+		if blockRemote {
+			sanitizer = h.exportBlockingSanitizer
+		}
+		doc.BodyHTML = template.HTML(sanitizer.Sanitize(h.embedInlineImages(email.BodyHTML, attachments)))
+	}
+
+	var body strings.Builder
+	if err := exportTemplate.Execute(&body, doc); err != nil {
+		h.logger.Error("Failed to render email export", "error", err, "email_id", emailID)
+		http.Error(w, "Failed to export email", http.StatusInternalServerError)
+		return
+	}
+
+	// The document only needs its own inline styles and embedded images
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.html"`, email.ID))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; style-src 'unsafe-inline'")
+	w.Write([]byte(body.String()))
+}
+
+// embedInlineImages replaces cid: references in html with data URIs of the matching
+// inline image attachments. References without a readable image are left for the
+// sanitizer to drop.
+func (h *EmailHandler) embedInlineImages(html string, attachments []*models.Attachment) string {
+	byContentID := make(map[string]*models.Attachment)
+	for _, att := range attachments {
+		if att.Disposition == models.DispositionInline && att.ContentID != "" {
+			byContentID[strings.ToLower(att.ContentID)] = att
+		}
+	}
+	if len(byContentID) == 0 {
+		return html
+	}
+
+	dataURIs := make(map[string]string)
+	return cidReference.ReplaceAllStringFunc(html, func(ref string) string {
+		contentID := ref[len("cid:"):]
+		if unescaped, err := url.PathUnescape(contentID); err == nil {
+			contentID = unescaped
+		}
+		contentID = strings.ToLower(contentID)
+
+		if uri, ok := dataURIs[contentID]; ok {
+			return uri
+		}
+		att, ok := byContentID[contentID]
+		if !ok {
+			return ref
+		}
+
+		data, err := h.store.ReadFile(h.store.ResolveTier(att.Filepath, att.StorageTier))
+		if err != nil {
+			h.logger.Warn("Failed to read inline attachment for export", "error", err, "attachment_id", att.ID)
+			return ref
+		}
+		contentType := imageContentType(att.Filename, data)
+		if !embeddableImageTypes[contentType] {
+			return ref
+		}
+
+		uri := "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+		dataURIs[contentID] = uri
+		return uri
+	})
+}
+
+// imageContentType returns the media type of an inline part, from its filename
+// extension when known and from its content otherwise
+func imageContentType(filename string, data []byte) string {
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
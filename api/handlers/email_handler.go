@@ -1,21 +1,30 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/oklog/ulid/v2"
 
 	"tmpemail_api/config"
 	"tmpemail_api/database"
+	"tmpemail_api/models"
+	"tmpemail_api/storage"
+	"tmpemail_api/websocket"
 )
 
 // EmailHandler handles email retrieval operations
@@ -23,25 +32,86 @@ type EmailHandler struct {
 	db        *database.DB
 	config    *config.Config
 	logger    *slog.Logger
+	store     *storage.Store
 	sanitizer *bluemonday.Policy
+
+	// blockingSanitizer additionally strips remote resource URLs (tracking pixels, remote images)
+	blockingSanitizer *bluemonday.Policy
+
+	// Export variants of the sanitizers also accept the data URI images embedded in exported HTML
+	exportSanitizer         *bluemonday.Policy
+	exportBlockingSanitizer *bluemonday.Policy
+
+	// hub notifies other connected clients of read-state changes (nil = no broadcasts)
+	hub *websocket.Hub
 }
 
 // NewEmailHandler creates a new email handler
-func NewEmailHandler(db *database.DB, cfg *config.Config, logger *slog.Logger) *EmailHandler {
+func NewEmailHandler(db *database.DB, cfg *config.Config, logger *slog.Logger, store *storage.Store) *EmailHandler {
+	return NewEmailHandlerWithHub(db, cfg, logger, store, nil)
+}
+
+// NewEmailHandlerWithHub creates a new email handler that broadcasts email_read
+// events to the address's WebSocket clients
+func NewEmailHandlerWithHub(db *database.DB, cfg *config.Config, logger *slog.Logger, store *storage.Store, hub *websocket.Hub) *EmailHandler {
 	// Create HTML sanitizer to prevent XSS
 	sanitizer := bluemonday.UGCPolicy()
+	blockingSanitizer := bluemonday.UGCPolicy().RewriteSrc(blockRemoteSrc)
+	exportSanitizer := bluemonday.UGCPolicy()
+	exportSanitizer.AllowDataURIImages()
+	exportBlockingSanitizer := bluemonday.UGCPolicy().RewriteSrc(blockRemoteSrc)
+	exportBlockingSanitizer.AllowDataURIImages()
 
 	return &EmailHandler{
-		db:        db,
-		config:    cfg,
-		logger:    logger,
-		sanitizer: sanitizer,
+		db:                db,
+		config:            cfg,
+		logger:            logger,
+		store:             store,
+		sanitizer:         sanitizer,
+		blockingSanitizer: blockingSanitizer,
+		hub:               hub,
+
+		exportSanitizer:         exportSanitizer,
+		exportBlockingSanitizer: exportBlockingSanitizer,
+	}
+}
+
+// blockRemoteSrc clears src URLs that would load content from a remote host
+func blockRemoteSrc(u *url.URL) {
+	if u.Host != "" || u.Scheme == "http" || u.Scheme == "https" {
+		*u = url.URL{}
 	}
 }
 
+// blockRemoteContent returns the address's remote content preference, overridden by
+// the block_remote_content query parameter when present
+func blockRemoteContent(r *http.Request, addr *models.EmailAddress) (bool, error) {
+	if block := r.URL.Query().Get("block_remote_content"); block != "" {
+		return strconv.ParseBool(block)
+	}
+	return addr.BlockRemoteContent, nil
+}
+
 // EmailListResponse represents the list of emails for an address
 type EmailListResponse struct {
-	Emails []EmailSummary `json:"emails"`
+	Emails    []EmailSummary `json:"emails"`
+	Truncated bool           `json:"truncated"` // True when more emails exist than the server-side cap allows
+}
+
+// ProjectedEmailListResponse represents the list of emails restricted to the requested fields
+type ProjectedEmailListResponse struct {
+	Emails    []map[string]interface{} `json:"emails"`
+	Truncated bool                     `json:"truncated"`
+}
+
+// summaryFields is the allowlist of fields selectable via the fields query parameter
+var summaryFields = map[string]bool{
+	"id":              true,
+	"from":            true,
+	"subject":         true,
+	"preview":         true,
+	"received_at":     true,
+	"has_attachments": true,
 }
 
 // EmailSummary represents a summary of an email
@@ -54,6 +124,12 @@ type EmailSummary struct {
 	HasAttachments bool   `json:"has_attachments"`
 }
 
+// EmailCountResponse represents the email counts for an address
+type EmailCountResponse struct {
+	Total  int `json:"total"`
+	Unread int `json:"unread"`
+}
+
 // EmailContentResponse represents the full content of an email
 type EmailContentResponse struct {
 	ID          string           `json:"id"`
@@ -63,12 +139,17 @@ type EmailContentResponse struct {
 	BodyText    string           `json:"body_text"`
 	ReceivedAt  string           `json:"received_at"`
 	Attachments []AttachmentInfo `json:"attachments"`
+
+	RemoteContentBlocked bool    `json:"remote_content_blocked"`
+	ReadAt               *string `json:"read_at"`           // null while unread
+	BodyTextDerived      bool    `json:"body_text_derived"` // body_text was generated from body_html
 }
 
 // AttachmentInfo represents attachment metadata
 type AttachmentInfo struct {
-	ID       string `json:"id"`
-	Filename string `json:"filename"`
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"` // "attachment" or "inline"
 }
 
 // AttachmentsResponse represents the list of attachments for an email
@@ -76,16 +157,16 @@ type AttachmentsResponse struct {
 	Files []AttachmentInfo `json:"files"`
 }
 
-// GetEmails handles GET /api/v1/emails/{address} - retrieves all emails for an address
+// GetEmails handles GET /api/v1/emails/{address} - retrieves all emails for an address,
+// or with ?after_id= only those received after the given email
 func (h *EmailHandler) GetEmails(w http.ResponseWriter, r *http.Request) {
 	address := chi.URLParam(r, "address")
-	if address == "" {
-		http.Error(w, "Missing address parameter", http.StatusBadRequest)
+	if !validAddressParam(w, address, h.config) {
 		return
 	}
 
 	// Validate address exists and is not expired
-	valid, expired, err := h.db.IsValidAddress(address)
+	valid, expired, err := h.db.IsValidAddressContext(r.Context(), address)
 	if err != nil {
 		h.logger.Error("Failed to validate address", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -102,11 +183,62 @@ func (h *EmailHandler) GetEmails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get emails
-	emails, err := h.db.GetEmailsByAddress(address)
+	// Parse optional field projection (e.g. fields=id,subject,received_at)
+	fields, err := parseSummaryFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get emails, fetching one extra row to detect truncation. With after_id only
+	// newer emails are returned, oldest first, so clients can sync incrementally.
+	var emails []*models.Email
+	if afterID := r.URL.Query().Get("after_id"); afterID != "" {
+		id, parseErr := ulid.ParseStrict(afterID)
+		if parseErr != nil {
+			http.Error(w, "Invalid after_id parameter. Use an email ID", http.StatusBadRequest)
+			return
+		}
+		emails, err = h.db.GetEmailsAfterIDContext(r.Context(), address, id.String(), h.listQueryLimit())
+	} else {
+		emails, err = h.db.GetEmailsByAddressContext(r.Context(), address, h.listQueryLimit())
+	}
 	if err != nil {
 		h.logger.Error("Failed to get emails", "error", err, "address", address)
-		http.Error(w, "Failed to retrieve emails", http.StatusInternalServerError)
+		writeQueryError(w, r, "Failed to retrieve emails")
+		return
+	}
+	emails, truncated := h.truncateList(emails)
+
+	if fields != nil {
+		projected := make([]map[string]interface{}, 0, len(emails))
+		for _, email := range emails {
+			summary := make(map[string]interface{}, len(fields))
+			for _, field := range fields {
+				switch field {
+				case "id":
+					summary["id"] = email.ID
+				case "from":
+					summary["from"] = email.FromAddress
+				case "subject":
+					summary["subject"] = email.Subject
+				case "preview":
+					summary["preview"] = email.BodyPreview
+				case "received_at":
+					summary["received_at"] = email.ReceivedAt.Format("2006-01-02T15:04:05Z07:00")
+				case "has_attachments":
+					// Only query attachments when the field is requested
+					attachments, _ := h.db.GetAttachmentsByEmailIDContext(r.Context(), email.ID)
+					summary["has_attachments"] = len(attachments) > 0
+				}
+			}
+			projected = append(projected, summary)
+		}
+
+		response := ProjectedEmailListResponse{Emails: projected, Truncated: truncated}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 
@@ -114,7 +246,7 @@ func (h *EmailHandler) GetEmails(w http.ResponseWriter, r *http.Request) {
 	summaries := make([]EmailSummary, 0, len(emails))
 	for _, email := range emails {
 		// Check if email has attachments
-		attachments, _ := h.db.GetAttachmentsByEmailID(email.ID)
+		attachments, _ := h.db.GetAttachmentsByEmailIDContext(r.Context(), email.ID)
 		hasAttachments := len(attachments) > 0
 
 		summaries = append(summaries, EmailSummary{
@@ -127,7 +259,106 @@ func (h *EmailHandler) GetEmails(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	response := EmailListResponse{Emails: summaries}
+	response := EmailListResponse{Emails: summaries, Truncated: truncated}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeQueryError reports a failed database query, answering 503 when the
+// request timeout cancelled it and 500 with message otherwise
+func writeQueryError(w http.ResponseWriter, r *http.Request, message string) {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
+// listQueryLimit returns the row limit for list queries: one more than the
+// configured cap so truncation can be detected (0 = unlimited)
+func (h *EmailHandler) listQueryLimit() int {
+	if h.config.MaxEmailsPerList <= 0 {
+		return 0
+	}
+	return h.config.MaxEmailsPerList + 1
+}
+
+// truncateList trims a list query result to the configured cap and reports whether it was truncated
+func (h *EmailHandler) truncateList(emails []*models.Email) ([]*models.Email, bool) {
+	if h.config.MaxEmailsPerList > 0 && len(emails) > h.config.MaxEmailsPerList {
+		return emails[:h.config.MaxEmailsPerList], true
+	}
+	return emails, false
+}
+
+// parseSummaryFields parses a comma-separated fields parameter against the
+// summary field allowlist. Returns nil when no projection was requested.
+func parseSummaryFields(param string) ([]string, error) {
+	if param == "" {
+		return nil, nil
+	}
+
+	fields := []string{}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(param, ",") {
+		field := strings.TrimSpace(part)
+		if field == "" || seen[field] {
+			continue
+		}
+		if !summaryFields[field] {
+			return nil, fmt.Errorf("Invalid field %q. Allowed fields: id, from, subject, preview, received_at, has_attachments", field)
+		}
+		seen[field] = true
+		fields = append(fields, field)
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Fields parameter must name at least one field")
+	}
+	return fields, nil
+}
+
+// GetEmailCount handles GET /api/v1/emails/{address}/count - returns total and unread email counts
+func (h *EmailHandler) GetEmailCount(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
+
+	// Validate address exists and is not expired
+	valid, expired, err := h.db.IsValidAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to validate address", "error", err, "address", address)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		http.Error(w, "Email address not found", http.StatusNotFound)
+		return
+	}
+
+	if expired {
+		http.Error(w, "Email address has expired", http.StatusGone)
+		return
+	}
+
+	total, err := h.db.CountEmailsByAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to count emails", "error", err, "address", address)
+		http.Error(w, "Failed to count emails", http.StatusInternalServerError)
+		return
+	}
+
+	unread, err := h.db.CountUnreadEmailsByAddressContext(r.Context(), address)
+	if err != nil {
+		h.logger.Error("Failed to count unread emails", "error", err, "address", address)
+		http.Error(w, "Failed to count emails", http.StatusInternalServerError)
+		return
+	}
+
+	response := EmailCountResponse{Total: total, Unread: unread}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -136,13 +367,12 @@ func (h *EmailHandler) GetEmails(w http.ResponseWriter, r *http.Request) {
 // GetEmailsFiltered handles GET /api/v1/emails/{address}/filter - retrieves emails with filters
 func (h *EmailHandler) GetEmailsFiltered(w http.ResponseWriter, r *http.Request) {
 	address := chi.URLParam(r, "address")
-	if address == "" {
-		http.Error(w, "Missing address parameter", http.StatusBadRequest)
+	if !validAddressParam(w, address, h.config) {
 		return
 	}
 
 	// Validate address exists and is not expired
-	valid, expired, err := h.db.IsValidAddress(address)
+	valid, expired, err := h.db.IsValidAddressContext(r.Context(), address)
 	if err != nil {
 		h.logger.Error("Failed to validate address", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -167,6 +397,15 @@ func (h *EmailHandler) GetEmailsFiltered(w http.ResponseWriter, r *http.Request)
 		filter.FromAddress = from
 	}
 
+	// from_domain parameter (any sender at the domain)
+	if fromDomain := r.URL.Query().Get("from_domain"); fromDomain != "" {
+		if !models.ValidDomainFormat(fromDomain) {
+			http.Error(w, "Invalid from_domain parameter. Use a domain such as example.com", http.StatusBadRequest)
+			return
+		}
+		filter.FromDomain = fromDomain
+	}
+
 	// subject parameter (contains)
 	if subject := r.URL.Query().Get("subject"); subject != "" {
 		filter.SubjectContains = subject
@@ -182,19 +421,41 @@ func (h *EmailHandler) GetEmailsFiltered(w http.ResponseWriter, r *http.Request)
 		filter.Since = &sinceTime
 	}
 
-	// Get filtered emails
-	emails, err := h.db.GetEmailsByFilter(address, filter)
+	// until parameter (RFC3339 format, inclusive)
+	if until := r.URL.Query().Get("until"); until != "" {
+		untilTime, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "Invalid until parameter. Use RFC3339 format (e.g., 2006-01-02T15:04:05Z)", http.StatusBadRequest)
+			return
+		}
+		filter.Until = &untilTime
+	}
+
+	// has_attachments parameter (true or false)
+	if hasAttachments := r.URL.Query().Get("has_attachments"); hasAttachments != "" {
+		value, err := strconv.ParseBool(hasAttachments)
+		if err != nil {
+			http.Error(w, "Invalid has_attachments parameter. Use true or false", http.StatusBadRequest)
+			return
+		}
+		filter.HasAttachments = &value
+	}
+
+	// Get filtered emails, fetching one extra row to detect truncation
+	filter.Limit = h.listQueryLimit()
+	emails, err := h.db.GetEmailsByFilterContext(r.Context(), address, filter)
 	if err != nil {
 		h.logger.Error("Failed to get filtered emails", "error", err, "address", address, "filter", filter)
-		http.Error(w, "Failed to retrieve emails", http.StatusInternalServerError)
+		writeQueryError(w, r, "Failed to retrieve emails")
 		return
 	}
+	emails, truncated := h.truncateList(emails)
 
 	// Convert to summaries
 	summaries := make([]EmailSummary, 0, len(emails))
 	for _, email := range emails {
 		// Check if email has attachments
-		attachments, _ := h.db.GetAttachmentsByEmailID(email.ID)
+		attachments, _ := h.db.GetAttachmentsByEmailIDContext(r.Context(), email.ID)
 		hasAttachments := len(attachments) > 0
 
 		summaries = append(summaries, EmailSummary{
@@ -207,7 +468,7 @@ func (h *EmailHandler) GetEmailsFiltered(w http.ResponseWriter, r *http.Request)
 		})
 	}
 
-	response := EmailListResponse{Emails: summaries}
+	response := EmailListResponse{Emails: summaries, Truncated: truncated}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -222,27 +483,56 @@ func (h *EmailHandler) GetEmailContent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing address or email ID parameter", http.StatusBadRequest)
 		return
 	}
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
 
-	// Validate address
-	valid, expired, err := h.db.IsValidAddress(address)
+	// Validate address (the address record also carries display preferences)
+	addr, err := h.db.GetAddressContext(r.Context(), address)
 	if err != nil {
 		h.logger.Error("Failed to validate address", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if !valid {
+	if addr == nil {
 		http.Error(w, "Email address not found", http.StatusNotFound)
 		return
 	}
 
-	if expired {
+	if addr.IsExpired() {
 		http.Error(w, "Email address has expired", http.StatusGone)
 		return
 	}
 
+	blockRemote, err := blockRemoteContent(r, addr)
+	if err != nil {
+		http.Error(w, "Invalid block_remote_content parameter. Use true or false", http.StatusBadRequest)
+		return
+	}
+
+	// Read state: the configured default, overridden by mark_read, and peek always leaves it untouched
+	markRead := h.config.AutoMarkRead
+	if mark := r.URL.Query().Get("mark_read"); mark != "" {
+		markRead, err = strconv.ParseBool(mark)
+		if err != nil {
+			http.Error(w, "Invalid mark_read parameter. Use true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if peekParam := r.URL.Query().Get("peek"); peekParam != "" {
+		peek, err := strconv.ParseBool(peekParam)
+		if err != nil {
+			http.Error(w, "Invalid peek parameter. Use true or false", http.StatusBadRequest)
+			return
+		}
+		if peek {
+			markRead = false
+		}
+	}
+
 	// Get email
-	email, err := h.db.GetEmailByID(address, emailID)
+	email, err := h.db.GetEmailByIDContext(r.Context(), address, emailID)
 	if err != nil {
 		h.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
 		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
@@ -254,8 +544,30 @@ func (h *EmailHandler) GetEmailContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if markRead && email.ReadAt == nil {
+		now := time.Now().UTC()
+		marked, err := h.db.MarkEmailReadContext(r.Context(), address, emailID, now)
+		if err != nil {
+			h.logger.Warn("Failed to mark email read", "error", err, "email_id", emailID)
+			// Still return the content
+		} else if marked {
+			email.ReadAt = &now
+
+			// Let other tabs and devices on this address update their unread state
+			if h.hub != nil {
+				h.hub.BroadcastToAddress(address, websocket.Message{
+					Type: "email_read",
+					Data: map[string]interface{}{
+						"id":      emailID,
+						"read_at": now.Format("2006-01-02T15:04:05Z07:00"),
+					},
+				})
+			}
+		}
+	}
+
 	// Get attachments
-	attachments, err := h.db.GetAttachmentsByEmailID(emailID)
+	attachments, err := h.db.GetAttachmentsByEmailIDContext(r.Context(), emailID)
 	if err != nil {
 		h.logger.Warn("Failed to get attachments", "error", err, "email_id", emailID)
 		// Continue without attachments on error
@@ -265,22 +577,42 @@ func (h *EmailHandler) GetEmailContent(w http.ResponseWriter, r *http.Request) {
 	attachmentInfos := make([]AttachmentInfo, 0, len(attachments))
 	for _, att := range attachments {
 		attachmentInfos = append(attachmentInfos, AttachmentInfo{
-			ID:       att.ID,
-			Filename: att.Filename,
+			ID:          att.ID,
+			Filename:    att.Filename,
+			Disposition: att.Disposition,
 		})
 	}
 
 	// Sanitize HTML content
-	sanitizedHTML := h.sanitizer.Sanitize(email.BodyHTML)
+	sanitizer := h.sanitizer
+	if blockRemote {
+		sanitizer = h.blockingSanitizer
+	}
+	sanitizedHTML := sanitizer.Sanitize(email.BodyHTML)
+
+	// Always provide a plain-text view, deriving one for HTML-only emails
+	bodyText := email.BodyText
+	bodyTextDerived := false
+	if strings.TrimSpace(bodyText) == "" && email.BodyHTML != "" {
+		bodyText = htmlToText(email.BodyHTML)
+		bodyTextDerived = true
+	}
 
 	response := EmailContentResponse{
 		ID:          email.ID,
 		From:        email.FromAddress,
 		Subject:     email.Subject,
 		BodyHTML:    sanitizedHTML,
-		BodyText:    email.BodyText,
+		BodyText:    bodyText,
 		ReceivedAt:  email.ReceivedAt.Format("2006-01-02T15:04:05Z07:00"),
 		Attachments: attachmentInfos,
+
+		RemoteContentBlocked: blockRemote,
+		BodyTextDerived:      bodyTextDerived,
+	}
+	if email.ReadAt != nil {
+		readAt := email.ReadAt.Format("2006-01-02T15:04:05Z07:00")
+		response.ReadAt = &readAt
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -296,9 +628,12 @@ func (h *EmailHandler) GetAttachments(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing address or email ID parameter", http.StatusBadRequest)
 		return
 	}
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
 
 	// Validate address
-	valid, expired, err := h.db.IsValidAddress(address)
+	valid, expired, err := h.db.IsValidAddressContext(r.Context(), address)
 	if err != nil {
 		h.logger.Error("Failed to validate address", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -315,8 +650,15 @@ func (h *EmailHandler) GetAttachments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional disposition filter (e.g. disposition=attachment hides inline images)
+	disposition := r.URL.Query().Get("disposition")
+	if disposition != "" && disposition != models.DispositionAttachment && disposition != models.DispositionInline {
+		http.Error(w, "Invalid disposition parameter. Use attachment or inline", http.StatusBadRequest)
+		return
+	}
+
 	// Verify email exists for this address
-	email, err := h.db.GetEmailByID(address, emailID)
+	email, err := h.db.GetEmailByIDContext(r.Context(), address, emailID)
 	if err != nil {
 		h.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
 		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
@@ -329,7 +671,7 @@ func (h *EmailHandler) GetAttachments(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get attachments
-	attachments, err := h.db.GetAttachmentsByEmailID(emailID)
+	attachments, err := h.db.GetAttachmentsByEmailIDContext(r.Context(), emailID)
 	if err != nil {
 		h.logger.Error("Failed to get attachments", "error", err, "email_id", emailID)
 		http.Error(w, "Failed to retrieve attachments", http.StatusInternalServerError)
@@ -339,9 +681,13 @@ func (h *EmailHandler) GetAttachments(w http.ResponseWriter, r *http.Request) {
 	// Convert to response format
 	files := make([]AttachmentInfo, 0, len(attachments))
 	for _, att := range attachments {
+		if disposition != "" && att.Disposition != disposition {
+			continue
+		}
 		files = append(files, AttachmentInfo{
-			ID:       att.ID,
-			Filename: att.Filename,
+			ID:          att.ID,
+			Filename:    att.Filename,
+			Disposition: att.Disposition,
 		})
 	}
 
@@ -361,9 +707,12 @@ func (h *EmailHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	if !validAddressParam(w, address, h.config) {
+		return
+	}
 
 	// Validate address
-	valid, expired, err := h.db.IsValidAddress(address)
+	valid, expired, err := h.db.IsValidAddressContext(r.Context(), address)
 	if err != nil {
 		h.logger.Error("Failed to validate address", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -381,7 +730,7 @@ func (h *EmailHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request
 	}
 
 	// Verify email exists for this address
-	email, err := h.db.GetEmailByID(address, emailID)
+	email, err := h.db.GetEmailByIDContext(r.Context(), address, emailID)
 	if err != nil {
 		h.logger.Error("Failed to get email", "error", err, "address", address, "email_id", emailID)
 		http.Error(w, "Failed to retrieve email", http.StatusInternalServerError)
@@ -394,7 +743,7 @@ func (h *EmailHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request
 	}
 
 	// Get the specific attachment
-	attachment, err := h.db.GetAttachmentByID(emailID, attachmentID)
+	attachment, err := h.db.GetAttachmentByIDContext(r.Context(), emailID, attachmentID)
 	if err != nil {
 		h.logger.Error("Failed to get attachment", "error", err, "email_id", emailID, "attachment_id", attachmentID)
 		http.Error(w, "Failed to retrieve attachment", http.StatusInternalServerError)
@@ -406,34 +755,28 @@ func (h *EmailHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	serveAttachment(w, h.store, h.logger, attachment)
+}
+
+// serveAttachment streams an attachment file as a download
+func serveAttachment(w http.ResponseWriter, store *storage.Store, logger *slog.Logger, attachment *models.Attachment) {
 	// Security: Ensure the file path is within the storage directory
-	cleanPath := filepath.Clean(attachment.Filepath)
-	if !filepath.IsAbs(cleanPath) {
-		cleanPath = filepath.Join(h.config.StoragePath, cleanPath)
-	}
+	cleanPath := store.ResolveTier(attachment.Filepath, attachment.StorageTier)
 
-	// Open the file
-	file, err := os.Open(cleanPath)
+	// Open the file (decrypted transparently when encryption at rest is enabled)
+	file, size, err := store.Open(cleanPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			h.logger.Warn("Attachment file not found", "path", cleanPath, "attachment_id", attachmentID)
+			logger.Warn("Attachment file not found", "path", cleanPath, "attachment_id", attachment.ID)
 			http.Error(w, "Attachment file not found", http.StatusNotFound)
 			return
 		}
-		h.logger.Error("Failed to open attachment file", "error", err, "path", cleanPath)
+		logger.Error("Failed to open attachment file", "error", err, "path", cleanPath)
 		http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
 
-	// Get file info for size
-	stat, err := file.Stat()
-	if err != nil {
-		h.logger.Error("Failed to stat attachment file", "error", err, "path", cleanPath)
-		http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
-		return
-	}
-
 	// Determine content type from filename extension
 	contentType := mime.TypeByExtension(filepath.Ext(attachment.Filename))
 	if contentType == "" {
@@ -443,15 +786,15 @@ func (h *EmailHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request
 	// Set headers for file download
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, attachment.Filename))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 	w.Header().Set("Cache-Control", "private, max-age=3600")
 
 	// Stream the file to the response
 	if _, err := io.Copy(w, file); err != nil {
-		h.logger.Error("Failed to stream attachment", "error", err, "attachment_id", attachmentID)
+		logger.Error("Failed to stream attachment", "error", err, "attachment_id", attachment.ID)
 		// Can't send error response here as headers are already sent
 		return
 	}
 
-	h.logger.Info("Served attachment", "attachment_id", attachmentID, "filename", attachment.Filename, "size", stat.Size())
+	logger.Info("Served attachment", "attachment_id", attachment.ID, "filename", attachment.Filename, "size", size)
 }
@@ -64,7 +64,7 @@ func (h *HealthHandler) Readiness(w http.ResponseWriter, r *http.Request) {
 	allHealthy := true
 
 	// Check database connectivity
-	if err := h.db.Ping(); err != nil {
+	if err := h.db.PingContext(r.Context()); err != nil {
 		checks["database"] = "unhealthy: " + err.Error()
 		allHealthy = false
 	} else {
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlBlockElements start on a new line in the plain-text rendering
+var htmlBlockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Br: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Footer: true, atom.Form: true, atom.H1: true, atom.H2: true, atom.H3: true,
+	atom.H4: true, atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true,
+	atom.Li: true, atom.Ol: true, atom.P: true, atom.Pre: true, atom.Section: true,
+	atom.Table: true, atom.Tr: true, atom.Ul: true,
+}
+
+// htmlSkippedElements have content that is never shown as text
+var htmlSkippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Template: true, atom.Title: true,
+}
+
+// htmlToText derives a plain-text version of an HTML body by dropping tags,
+// decoding entities and keeping line breaks between block elements
+func htmlToText(body string) string {
+	var b strings.Builder
+	skipDepth := 0
+	pendingSpace := false
+
+	newline := func() {
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteByte('\n')
+		}
+		pendingSpace = false
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			a := atom.Lookup(name)
+			if htmlSkippedElements[a] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				} else if tt == html.EndTagToken && skipDepth > 0 {
+					skipDepth--
+				}
+			}
+			if htmlBlockElements[a] {
+				newline()
+			}
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			// Text() decodes entities; collapse HTML whitespace like a browser would
+			raw := string(z.Text())
+			words := strings.Fields(raw)
+			if len(words) == 0 {
+				pendingSpace = pendingSpace || raw != ""
+				continue
+			}
+			leadingSpace := strings.TrimLeftFunc(raw, unicode.IsSpace) != raw
+			if (pendingSpace || leadingSpace) && b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+				b.WriteByte(' ')
+			}
+			b.WriteString(strings.Join(words, " "))
+			pendingSpace = strings.TrimRightFunc(raw, unicode.IsSpace) != raw
+		}
+	}
+}
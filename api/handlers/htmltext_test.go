@@ -0,0 +1,39 @@
+package handlers
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "plain text", body: "hello world", want: "hello world"},
+		{name: "inline tags", body: "<p>Hello <b>bold</b> <i>world</i></p>", want: "Hello bold world"},
+		{name: "block elements break lines", body: "<p>one</p><p>two</p><div>three</div>", want: "one\ntwo\nthree"},
+		{name: "br", body: "line one<br>line two<br/>line three", want: "line one\nline two\nline three"},
+		{name: "list items", body: "<ul><li>a</li><li>b</li></ul>", want: "a\nb"},
+		{name: "collapses whitespace", body: "<p>  lots \n\t of   space  </p>", want: "lots of space"},
+		{name: "space between inline elements", body: "<span>a</span> <span>b</span>", want: "a b"},
+		{name: "no space added inside words", body: "<b>bo</b>ld", want: "bold"},
+		{name: "named entities", body: "Fish &amp; chips &lt;3 &quot;yum&quot;", want: `Fish & chips <3 "yum"`},
+		{name: "numeric entities", body: "caf&#233; &#x20AC;5", want: "café €5"},
+		{name: "nbsp entity collapses to a space", body: "a&nbsp;&nbsp;b", want: "a b"},
+		{name: "script dropped", body: "<p>before</p><script>alert('x')</script><p>after</p>", want: "before\nafter"},
+		{name: "style dropped", body: "<style>p { color: red; }</style><p>text</p>", want: "text"},
+		{name: "head and title dropped", body: "<html><head><title>Subject</title></head><body>body</body></html>", want: "body"},
+		{name: "template dropped", body: "<template><p>hidden</p></template>shown", want: "shown"},
+		{name: "script text with tags", body: "<script>document.write('<p>x</p>')</script>visible", want: "visible"},
+		{name: "comments dropped", body: "a<!-- hidden -->b", want: "ab"},
+		{name: "empty", body: "", want: ""},
+		{name: "only markup", body: "<div><br></div>", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToText(tt.body); got != tt.want {
+				t.Errorf("htmlToText(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
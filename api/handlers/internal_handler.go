@@ -9,25 +9,35 @@ import (
 
 	"tmpemail_api/config"
 	"tmpemail_api/database"
+	"tmpemail_api/forwarding"
+	"tmpemail_api/middleware"
 	"tmpemail_api/models"
 	"tmpemail_api/websocket"
 )
 
 // InternalHandler handles internal API endpoints for Email Service communication
 type InternalHandler struct {
-	db     *database.DB
-	config *config.Config
-	logger *slog.Logger
-	hub    *websocket.Hub
+	db        *database.DB
+	config    *config.Config
+	logger    *slog.Logger
+	hub       *websocket.Hub
+	forwarder *forwarding.Forwarder // nil when forwarding is disabled
 }
 
 // NewInternalHandler creates a new internal handler
 func NewInternalHandler(db *database.DB, cfg *config.Config, logger *slog.Logger, hub *websocket.Hub) *InternalHandler {
+	return NewInternalHandlerWithForwarder(db, cfg, logger, hub, nil)
+}
+
+// NewInternalHandlerWithForwarder creates a new internal handler that relays stored
+// emails of addresses with a forwarding target through forwarder
+func NewInternalHandlerWithForwarder(db *database.DB, cfg *config.Config, logger *slog.Logger, hub *websocket.Hub, forwarder *forwarding.Forwarder) *InternalHandler {
 	return &InternalHandler{
-		db:     db,
-		config: cfg,
-		logger: logger,
-		hub:    hub,
+		db:        db,
+		config:    cfg,
+		logger:    logger,
+		hub:       hub,
+		forwarder: forwarder,
 	}
 }
 
@@ -37,20 +47,23 @@ type ValidationResponse struct {
 	Expired      bool  `json:"expired"`
 	StorageUsed  int64 `json:"storage_used"`  // Current storage used in bytes
 	StorageQuota int64 `json:"storage_quota"` // Max storage allowed in bytes (0 = unlimited)
+	QuotaWarning bool  `json:"quota_warning"` // Usage has reached the configured warning percentage of the quota
 }
 
 // ValidateAddress handles GET /internal/email/{address} - validates if an address exists and is not expired
 func (ih *InternalHandler) ValidateAddress(w http.ResponseWriter, r *http.Request) {
-	address := chi.URLParam(r, "address")
-	if address == "" {
-		http.Error(w, "Missing address parameter", http.StatusBadRequest)
+	// The Email Service sends its per-message trace ID as X-Request-ID
+	logger := ih.logger.With("trace_id", middleware.GetRequestID(r.Context()))
+
+	address := models.NormalizeAddress(chi.URLParam(r, "address"), ih.config.DotInsensitiveDomains)
+	if !validAddressParam(w, address, ih.config) {
 		return
 	}
 
 	// Validate address
-	valid, expired, err := ih.db.IsValidAddress(address)
+	valid, expired, err := ih.db.IsValidAddressContext(r.Context(), address)
 	if err != nil {
-		ih.logger.Error("Failed to validate address", "error", err, "address", address)
+		logger.Error("Failed to validate address", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -58,9 +71,9 @@ func (ih *InternalHandler) ValidateAddress(w http.ResponseWriter, r *http.Reques
 	// Get storage used (only if address is valid)
 	var storageUsed int64
 	if valid {
-		storageUsed, err = ih.db.GetStorageUsedByAddress(address)
+		storageUsed, err = ih.db.GetStorageUsedByAddressContext(r.Context(), address)
 		if err != nil {
-			ih.logger.Error("Failed to get storage used", "error", err, "address", address)
+			logger.Error("Failed to get storage used", "error", err, "address", address)
 			// Don't fail the request, just log and continue with 0
 			storageUsed = 0
 		}
@@ -71,12 +84,22 @@ func (ih *InternalHandler) ValidateAddress(w http.ResponseWriter, r *http.Reques
 		Expired:      expired,
 		StorageUsed:  storageUsed,
 		StorageQuota: ih.config.StorageQuotaPerAddress,
+		QuotaWarning: quotaWarning(storageUsed, ih.config.StorageQuotaPerAddress, ih.config.QuotaWarningPercent),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// quotaWarning reports whether used has reached percent of quota. An unlimited quota or a
+// non-positive percent never warns.
+func quotaWarning(used, quota int64, percent int) bool {
+	if quota <= 0 || percent <= 0 {
+		return false
+	}
+	return used*100 >= quota*int64(percent)
+}
+
 // StoreEmailRequest represents the request to store an email
 type StoreEmailRequest struct {
 	To              string   `json:"to"`
@@ -90,6 +113,15 @@ type StoreEmailRequest struct {
 	AttachmentPaths []string `json:"attachment_paths"`
 	AttachmentNames []string `json:"attachment_names"`
 	AttachmentSizes []int64  `json:"attachment_sizes"`
+
+	// AttachmentDispositions is parallel to AttachmentPaths; omitted by older senders, which means "attachment"
+	AttachmentDispositions []string `json:"attachment_dispositions,omitempty"`
+
+	// AttachmentContentIDs is parallel to AttachmentPaths; omitted by older senders
+	AttachmentContentIDs []string `json:"attachment_content_ids,omitempty"`
+
+	// AttachmentTiers is parallel to AttachmentPaths; omitted by older senders, which means "hot"
+	AttachmentTiers []string `json:"attachment_tiers,omitempty"`
 }
 
 // StoreEmailResponse represents the response for storing an email
@@ -101,7 +133,9 @@ type StoreEmailResponse struct {
 
 // StoreEmail handles POST /internal/email/{address}/store - stores email from Email Service
 func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
-	address := chi.URLParam(r, "address")
+	logger := ih.logger.With("trace_id", middleware.GetRequestID(r.Context()))
+
+	address := models.NormalizeAddress(chi.URLParam(r, "address"), ih.config.DotInsensitiveDomains)
 	if address == "" {
 		response := StoreEmailResponse{Success: false, Message: "Missing address parameter"}
 		w.Header().Set("Content-Type", "application/json")
@@ -111,9 +145,9 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate address exists and not expired
-	valid, expired, err := ih.db.IsValidAddress(address)
+	addr, err := ih.db.GetAddressContext(r.Context(), address)
 	if err != nil {
-		ih.logger.Error("Failed to validate address", "error", err, "address", address)
+		logger.Error("Failed to validate address", "error", err, "address", address)
 		response := StoreEmailResponse{Success: false, Message: "Failed to validate address"}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -121,8 +155,8 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !valid {
-		ih.logger.Warn("Attempted to store email for non-existent address", "address", address)
+	if addr == nil {
+		logger.Warn("Attempted to store email for non-existent address", "address", address)
 		response := StoreEmailResponse{Success: false, Message: "Email address does not exist"}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
@@ -130,8 +164,8 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if expired {
-		ih.logger.Warn("Attempted to store email for expired address", "address", address)
+	if addr.IsExpired() {
+		logger.Warn("Attempted to store email for expired address", "address", address)
 		response := StoreEmailResponse{Success: false, Message: "Email address has expired"}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusGone)
@@ -142,7 +176,7 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 	// Parse request body
 	var req StoreEmailRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		ih.logger.Error("Failed to parse request body", "error", err)
+		logger.Error("Failed to parse request body", "error", err)
 		response := StoreEmailResponse{Success: false, Message: "Invalid request body"}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -150,6 +184,68 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Attachment metadata is sent as parallel arrays; reject mismatched lengths
+	// rather than storing attachments with the wrong name or size
+	if len(req.AttachmentNames) != len(req.AttachmentPaths) || len(req.AttachmentSizes) != len(req.AttachmentPaths) {
+		logger.Warn("Attachment metadata length mismatch",
+			"address", address,
+			"paths", len(req.AttachmentPaths),
+			"names", len(req.AttachmentNames),
+			"sizes", len(req.AttachmentSizes),
+		)
+		response := StoreEmailResponse{Success: false, Message: "Attachment paths, names and sizes must have equal length"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if len(req.AttachmentDispositions) != 0 && len(req.AttachmentDispositions) != len(req.AttachmentPaths) {
+		logger.Warn("Attachment disposition length mismatch",
+			"address", address,
+			"paths", len(req.AttachmentPaths),
+			"dispositions", len(req.AttachmentDispositions),
+		)
+		response := StoreEmailResponse{Success: false, Message: "Attachment dispositions must match attachment paths"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if len(req.AttachmentContentIDs) != 0 && len(req.AttachmentContentIDs) != len(req.AttachmentPaths) {
+		logger.Warn("Attachment content ID length mismatch",
+			"address", address,
+			"paths", len(req.AttachmentPaths),
+			"content_ids", len(req.AttachmentContentIDs),
+		)
+		response := StoreEmailResponse{Success: false, Message: "Attachment content IDs must match attachment paths"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if len(req.AttachmentTiers) != 0 && len(req.AttachmentTiers) != len(req.AttachmentPaths) {
+		logger.Warn("Attachment tier length mismatch",
+			"address", address,
+			"paths", len(req.AttachmentPaths),
+			"tiers", len(req.AttachmentTiers),
+		)
+		response := StoreEmailResponse{Success: false, Message: "Attachment tiers must match attachment paths"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	for _, size := range req.AttachmentSizes {
+		if size < 0 {
+			logger.Warn("Negative attachment size in store request", "address", address, "size", size)
+			response := StoreEmailResponse{Success: false, Message: "Attachment sizes must not be negative"}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
 	// Generate preview (first 200 characters of text body)
 	preview := req.BodyText
 	if len(preview) > 200 {
@@ -167,9 +263,24 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 		req.FilePath,
 	)
 
-	// Insert email into database
-	if err := ih.db.InsertEmail(email); err != nil {
-		ih.logger.Error("Failed to insert email", "error", err, "address", address)
+	attachments := make([]*models.Attachment, 0, len(req.AttachmentPaths))
+	for i, path := range req.AttachmentPaths {
+		att := models.NewAttachment(email.ID, req.AttachmentNames[i], path, req.AttachmentSizes[i])
+		if len(req.AttachmentDispositions) > 0 && req.AttachmentDispositions[i] == models.DispositionInline {
+			att.Disposition = models.DispositionInline
+		}
+		if len(req.AttachmentContentIDs) > 0 {
+			att.ContentID = req.AttachmentContentIDs[i]
+		}
+		if len(req.AttachmentTiers) > 0 && req.AttachmentTiers[i] == models.StorageTierCold {
+			att.StorageTier = models.StorageTierCold
+		}
+		attachments = append(attachments, att)
+	}
+
+	// Insert the email and its attachments together; a failure stores neither
+	if err := ih.db.InsertEmailWithAttachmentsContext(r.Context(), email, attachments); err != nil {
+		logger.Error("Failed to insert email", "error", err, "address", address, "attachment_count", len(attachments))
 		response := StoreEmailResponse{Success: false, Message: "Failed to store email"}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -177,28 +288,12 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert attachments if any
-	if len(req.AttachmentPaths) > 0 {
-		for i, path := range req.AttachmentPaths {
-			filename := ""
-			size := int64(0)
-
-			if i < len(req.AttachmentNames) {
-				filename = req.AttachmentNames[i]
-			}
-			if i < len(req.AttachmentSizes) {
-				size = req.AttachmentSizes[i]
-			}
-
-			att := models.NewAttachment(email.ID, filename, path, size)
-			if err := ih.db.InsertAttachment(att); err != nil {
-				ih.logger.Error("Failed to insert attachment", "error", err, "email_id", email.ID, "filename", filename)
-				// Continue even if attachment insert fails
-			}
-		}
+	if err := ih.db.TouchLastEmailAtContext(r.Context(), address, email.ReceivedAt); err != nil {
+		logger.Error("Failed to update last email time", "error", err, "address", address)
+		// Email is already stored; the activity timestamp is best effort
 	}
 
-	ih.logger.Info("Stored new email", "address", address, "email_id", email.ID, "from", req.From, "subject", req.Subject)
+	logger.Info("Stored new email", "address", address, "email_id", email.ID, "from", req.From, "subject", req.Subject)
 
 	// Broadcast to WebSocket clients
 	ih.hub.BroadcastToAddress(address, websocket.Message{
@@ -212,6 +307,16 @@ func (ih *InternalHandler) StoreEmail(w http.ResponseWriter, r *http.Request) {
 		},
 	})
 
+	// Relay to the address's permanent mailbox when it opted in to forwarding and the
+	// target is still on an allowed domain
+	if ih.forwarder != nil && addr.ForwardTo != "" && req.RawEmail != "" {
+		if forwardTargetAllowed(addr.ForwardTo, ih.config.ForwardAllowedDomains) {
+			ih.forwarder.Forward(address, addr.ForwardTo, []byte(req.RawEmail), logger.With("email_id", email.ID))
+		} else {
+			logger.Warn("Not forwarding to a domain that is no longer allowed", "forward_to", addr.ForwardTo)
+		}
+	}
+
 	// Return success response
 	response := StoreEmailResponse{
 		Success: true,
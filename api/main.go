@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -16,8 +17,11 @@ import (
 	"tmpemail_api/cleanup"
 	"tmpemail_api/config"
 	"tmpemail_api/database"
+	"tmpemail_api/forwarding"
 	"tmpemail_api/handlers"
 	"tmpemail_api/middleware"
+	"tmpemail_api/models"
+	"tmpemail_api/storage"
 	"tmpemail_api/websocket"
 )
 
@@ -38,6 +42,12 @@ func main() {
 		"cleanup_interval", cfg.CleanupInterval.String(),
 	)
 
+	// Check the address generation settings before anything is served
+	if _, err := models.NewAddressGenerator(cfg.AddressStyle, cfg.PassphraseWords); err != nil {
+		logger.Error("Invalid TMPEMAIL_ADDRESS_STYLE or TMPEMAIL_PASSPHRASE_WORDS", "error", err)
+		os.Exit(1)
+	}
+
 	// Ensure storage directory exists
 	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
 		logger.Error("Failed to create storage directory", "error", err, "path", cfg.StoragePath)
@@ -60,15 +70,27 @@ func main() {
 	defer db.Close()
 	logger.Info("Database initialized", "path", cfg.DBPath)
 
+	// Set up file access, decrypting stored files if encryption at rest is enabled
+	var fileCipher *storage.Cipher
+	if cfg.EncryptionKey != "" {
+		fileCipher, err = newFileCipher(cfg)
+		if err != nil {
+			logger.Error("Failed to initialize storage encryption", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Storage encryption at rest enabled", "old_keys", len(cfg.EncryptionOldKeys))
+	}
+	store := storage.NewStoreWithColdPath(cfg.StoragePath, cfg.ColdStoragePath, fileCipher)
+
 	// Create WebSocket hub
-	hub := websocket.NewHub(logger)
+	hub := websocket.NewHubWithConfig(logger, cfg)
 	go hub.Run()
 	logger.Info("WebSocket hub started")
 
 	// Create rate limiters for different endpoints
-	generateRateLimiter := middleware.NewRateLimiterWithName(cfg.RateLimitGenerate, "generate")
-	apiRateLimiter := middleware.NewRateLimiterWithName(cfg.RateLimitAPI, "api")
-	wsRateLimiter := middleware.NewRateLimiterWithName(cfg.RateLimitWS, "websocket")
+	generateRateLimiter := middleware.NewRateLimiterWithMaxIPs(cfg.RateLimitGenerate, "generate", cfg.RateLimitMaxIPs)
+	apiRateLimiter := middleware.NewRateLimiterWithMaxIPs(cfg.RateLimitAPI, "api", cfg.RateLimitMaxIPs)
+	wsRateLimiter := middleware.NewRateLimiterWithMaxIPs(cfg.RateLimitWS, "websocket", cfg.RateLimitMaxIPs)
 
 	// Start rate limiter cleanup goroutine
 	go func() {
@@ -84,9 +106,35 @@ func main() {
 	// Create handlers
 	healthHandler := handlers.NewHealthHandler(db)
 	addressHandler := handlers.NewAddressHandler(db, cfg, logger)
-	emailHandler := handlers.NewEmailHandler(db, cfg, logger)
-	internalHandler := handlers.NewInternalHandler(db, cfg, logger, hub)
-	wsHandler := websocket.NewHandlerWithRateLimiter(hub, db, logger, wsRateLimiter)
+	emailHandler := handlers.NewEmailHandlerWithHub(db, cfg, logger, store, hub)
+	var forwarder *forwarding.Forwarder
+	if cfg.ForwardingEnabled {
+		if cfg.ForwardSMTPAddr == "" {
+			logger.Error("TMPEMAIL_FORWARDING_ENABLED requires TMPEMAIL_FORWARD_SMTP_ADDR")
+			os.Exit(1)
+		}
+		if cfg.OutboundTLSPolicy != "opportunistic" && cfg.OutboundTLSPolicy != "required" {
+			logger.Error("Invalid TMPEMAIL_OUTBOUND_TLS_POLICY, use opportunistic or required", "policy", cfg.OutboundTLSPolicy)
+			os.Exit(1)
+		}
+		if _, err := cfg.OutboundTLSVersion(); err != nil {
+			logger.Error("Invalid TMPEMAIL_OUTBOUND_TLS_MIN_VERSION", "error", err)
+			os.Exit(1)
+		}
+		if len(cfg.ForwardAllowedDomains) == 0 {
+			logger.Warn("TMPEMAIL_FORWARDING_ENABLED without TMPEMAIL_FORWARD_ALLOWED_DOMAINS, every forward_to will be refused")
+		}
+		forwarder = forwarding.NewForwarder(cfg, logger)
+		logger.Info("Email forwarding enabled",
+			"smtp_addr", cfg.ForwardSMTPAddr,
+			"tls_policy", cfg.OutboundTLSPolicy,
+			"tls_min_version", cfg.OutboundTLSMinVersion,
+			"allowed_domains", cfg.ForwardAllowedDomains,
+		)
+	}
+	internalHandler := handlers.NewInternalHandlerWithForwarder(db, cfg, logger, hub, forwarder)
+	adminHandler := handlers.NewAdminHandler(db, cfg, logger, store)
+	wsHandler := websocket.NewHandlerWithConfig(hub, db, cfg, logger, wsRateLimiter)
 
 	// Setup chi router
 	r := chi.NewRouter()
@@ -115,13 +163,20 @@ func main() {
 	// API v1 routes
 	// ==========================================
 	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(middleware.Timeout(cfg.RequestTimeout))
+
 		// Generate endpoint with stricter rate limiting
 		r.With(generateRateLimiter.Middleware).Get("/generate", addressHandler.Generate)
+		r.With(apiRateLimiter.Middleware).Put("/address/{address}/preferences", addressHandler.UpdatePreferences)
+		r.With(apiRateLimiter.Middleware).Get("/address/{address}/status", addressHandler.GetStatus)
+		r.With(apiRateLimiter.Middleware).Get("/addresses", addressHandler.ListSessionAddresses)
 
 		// Email endpoints with standard rate limiting
 		r.With(apiRateLimiter.Middleware).Get("/emails/{address}", emailHandler.GetEmails)
 		r.With(apiRateLimiter.Middleware).Get("/emails/{address}/filter", emailHandler.GetEmailsFiltered)
+		r.With(apiRateLimiter.Middleware).Get("/emails/{address}/count", emailHandler.GetEmailCount)
 		r.With(apiRateLimiter.Middleware).Get("/email/{address}/{emailID}", emailHandler.GetEmailContent)
+		r.With(apiRateLimiter.Middleware).Get("/email/{address}/{emailID}/export.html", emailHandler.ExportHTML)
 		r.With(apiRateLimiter.Middleware).Get("/email/{address}/{emailID}/attachments", emailHandler.GetAttachments)
 		r.With(apiRateLimiter.Middleware).Get("/email/{address}/{emailID}/attachments/{attachmentID}", emailHandler.DownloadAttachment)
 	})
@@ -130,9 +185,25 @@ func main() {
 	// Internal routes (for Email Service)
 	// ==========================================
 	r.Route("/internal/v1", func(r chi.Router) {
+		r.Use(middleware.InternalAuth(cfg.InternalAPIKey))
+		r.Use(middleware.Timeout(cfg.RequestTimeout))
+
 		r.Get("/email/{address}", internalHandler.ValidateAddress)
 		r.Post("/email/{address}/store", internalHandler.StoreEmail)
+
+		// Admin endpoints bypass expiry checks, so they only exist when internal auth is configured
+		if cfg.InternalAPIKey != "" {
+			r.Get("/admin/address/{address}", adminHandler.GetAddress)
+			r.Get("/admin/emails/{address}", adminHandler.GetEmails)
+			r.Get("/admin/email/{address}/{emailID}", adminHandler.GetEmail)
+			r.Get("/admin/email/{address}/{emailID}/attachments/{attachmentID}", adminHandler.DownloadAttachment)
+			r.Get("/email/{address}/{emailID}/mime-debug", adminHandler.MIMEDebug)
+			r.Get("/generate/preview", adminHandler.GeneratePreview)
+		}
 	})
+	if cfg.InternalAPIKey == "" {
+		logger.Warn("TMPEMAIL_INTERNAL_API_KEY not set: internal endpoints are unauthenticated and admin endpoints are disabled")
+	}
 
 	// Create HTTP server
 	server := &http.Server{
@@ -179,3 +250,20 @@ func main() {
 
 	logger.Info("Server stopped")
 }
+
+// newFileCipher builds the storage cipher from the configured current and old keys
+func newFileCipher(cfg *config.Config) (*storage.Cipher, error) {
+	currentKey, err := storage.ParseKey(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	oldKeys := make([][]byte, 0, len(cfg.EncryptionOldKeys))
+	for _, encoded := range cfg.EncryptionOldKeys {
+		key, err := storage.ParseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid old key: %w", err)
+		}
+		oldKeys = append(oldKeys, key)
+	}
+	return storage.NewCipher(currentKey, oldKeys)
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"container/list"
 	"net/http"
 	"sync"
 	"time"
@@ -9,12 +10,20 @@ import (
 // RateLimiter implements a simple in-memory rate limiter
 type RateLimiter struct {
 	mu       sync.Mutex
-	requests map[string][]time.Time
+	requests map[string]*list.Element // IP -> element of order holding its *ipRequests
+	order    *list.List               // Tracked IPs, most recently seen first
+	maxIPs   int                      // Max tracked IPs before the least recently seen is evicted (0 = unlimited)
 	limit    int
 	window   time.Duration
 	name     string
 }
 
+// ipRequests holds the request timestamps of one IP
+type ipRequests struct {
+	ip         string
+	timestamps []time.Time
+}
+
 // NewRateLimiter creates a new rate limiter with the specified requests per minute
 func NewRateLimiter(requestsPerMinute int) *RateLimiter {
 	return NewRateLimiterWithName(requestsPerMinute, "default")
@@ -22,8 +31,17 @@ func NewRateLimiter(requestsPerMinute int) *RateLimiter {
 
 // NewRateLimiterWithName creates a new rate limiter with a name for identification
 func NewRateLimiterWithName(requestsPerMinute int, name string) *RateLimiter {
+	return NewRateLimiterWithMaxIPs(requestsPerMinute, name, 0)
+}
+
+// NewRateLimiterWithMaxIPs creates a named rate limiter that tracks at most maxIPs
+// addresses, evicting the least recently seen one when a new IP arrives (0 = unlimited).
+// This bounds memory when a flood of distinct IPs arrives between cleanups.
+func NewRateLimiterWithMaxIPs(requestsPerMinute int, name string, maxIPs int) *RateLimiter {
 	return &RateLimiter{
-		requests: make(map[string][]time.Time),
+		requests: make(map[string]*list.Element),
+		order:    list.New(),
+		maxIPs:   maxIPs,
 		limit:    requestsPerMinute,
 		window:   time.Minute,
 		name:     name,
@@ -44,19 +62,17 @@ func (rl *RateLimiter) isLimited(ip string) bool {
 	now := time.Now()
 	windowStart := now.Add(-rl.window)
 
-	// Get request timestamps for this IP
-	timestamps, exists := rl.requests[ip]
-	if !exists {
-		timestamps = []time.Time{}
-	}
+	// Get request timestamps for this IP, tracking it if it is new
+	entry := rl.track(ip)
 
 	// Filter out requests outside the time window
-	validTimestamps := make([]time.Time, 0, len(timestamps))
-	for _, ts := range timestamps {
+	validTimestamps := make([]time.Time, 0, len(entry.timestamps))
+	for _, ts := range entry.timestamps {
 		if ts.After(windowStart) {
 			validTimestamps = append(validTimestamps, ts)
 		}
 	}
+	entry.timestamps = validTimestamps
 
 	// Check if limit is exceeded
 	if len(validTimestamps) >= rl.limit {
@@ -64,12 +80,31 @@ func (rl *RateLimiter) isLimited(ip string) bool {
 	}
 
 	// Add current request
-	validTimestamps = append(validTimestamps, now)
-	rl.requests[ip] = validTimestamps
+	entry.timestamps = append(validTimestamps, now)
 
 	return false
 }
 
+// track returns the entry for ip and marks it most recently seen. A new IP
+// evicts the least recently seen one when maxIPs are already tracked.
+// Must be called with rl.mu held.
+func (rl *RateLimiter) track(ip string) *ipRequests {
+	if elem, ok := rl.requests[ip]; ok {
+		rl.order.MoveToFront(elem)
+		return elem.Value.(*ipRequests)
+	}
+
+	if rl.maxIPs > 0 && rl.order.Len() >= rl.maxIPs {
+		oldest := rl.order.Back()
+		rl.order.Remove(oldest)
+		delete(rl.requests, oldest.Value.(*ipRequests).ip)
+	}
+
+	entry := &ipRequests{ip: ip}
+	rl.requests[ip] = rl.order.PushFront(entry)
+	return entry
+}
+
 // Middleware returns a chi-compatible middleware function
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -100,18 +135,23 @@ func (rl *RateLimiter) Cleanup() {
 	now := time.Now()
 	windowStart := now.Add(-rl.window)
 
-	for ip, timestamps := range rl.requests {
-		validTimestamps := make([]time.Time, 0, len(timestamps))
-		for _, ts := range timestamps {
+	for elem := rl.order.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*ipRequests)
+
+		validTimestamps := make([]time.Time, 0, len(entry.timestamps))
+		for _, ts := range entry.timestamps {
 			if ts.After(windowStart) {
 				validTimestamps = append(validTimestamps, ts)
 			}
 		}
 
 		if len(validTimestamps) == 0 {
-			delete(rl.requests, ip)
+			rl.order.Remove(elem)
+			delete(rl.requests, entry.ip)
 		} else {
-			rl.requests[ip] = validTimestamps
+			entry.timestamps = validTimestamps
 		}
+		elem = next
 	}
 }
@@ -2,6 +2,8 @@ package models
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"math/big"
 	"strings"
@@ -16,6 +18,18 @@ type EmailAddress struct {
 	Address   string    `db:"address" json:"address"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+
+	// BlockRemoteContent strips remote resources (e.g. tracking images) from HTML bodies by default
+	BlockRemoteContent bool `db:"block_remote_content" json:"block_remote_content"`
+
+	// LastEmailAt is when the most recent email was stored (nil if none has arrived)
+	LastEmailAt *time.Time `db:"last_email_at" json:"last_email_at"`
+
+	// SessionTokenHash links the address to the client session that generated it (empty if none)
+	SessionTokenHash string `db:"session_token_hash" json:"-"`
+
+	// ForwardTo is the mailbox received mail is relayed to (empty = no forwarding)
+	ForwardTo string `db:"forward_to" json:"forward_to"`
 }
 
 // Email represents a received email
@@ -29,6 +43,9 @@ type Email struct {
 	BodyHTML    string    `db:"body_html" json:"body_html"`
 	FilePath    string    `db:"file_path" json:"file_path"`
 	ReceivedAt  time.Time `db:"received_at" json:"received_at"`
+
+	// ReadAt is when the email was first marked read (nil while unread)
+	ReadAt *time.Time `db:"read_at" json:"read_at"`
 }
 
 // Attachment represents an email attachment
@@ -38,6 +55,15 @@ type Attachment struct {
 	Filename string `db:"filename" json:"filename"`
 	Filepath string `db:"filepath" json:"filepath"`
 	Size     int64  `db:"size" json:"size"`
+
+	// Disposition is "attachment" for regular attachments or "inline" for parts embedded in the HTML body
+	Disposition string `db:"disposition" json:"disposition"`
+
+	// ContentID is the part's Content-ID without angle brackets, referenced from the HTML body as cid:<id>
+	ContentID string `db:"content_id" json:"content_id,omitempty"`
+
+	// StorageTier is the storage root the file was written to: "hot" or "cold"
+	StorageTier string `db:"storage_tier" json:"storage_tier"`
 }
 
 // Adjectives for readable email addresses
@@ -90,9 +116,126 @@ func GenerateEmailAddress(domain string) (string, error) {
 	return strings.ToLower(address), nil
 }
 
+// AddressGenerator produces a random email address for a domain
+type AddressGenerator func(domain string) (string, error)
+
+// NewAddressGenerator returns the generator for an address style: "readable"
+// (adjective-noun-number) or "passphrase" with the given number of words
+func NewAddressGenerator(style string, words int) (AddressGenerator, error) {
+	switch style {
+	case "readable":
+		return GenerateEmailAddress, nil
+	case "passphrase":
+		if words < 2 {
+			return nil, fmt.Errorf("passphrase addresses need at least 2 words, got %d", words)
+		}
+		return PassphraseGenerator(words), nil
+	}
+	return nil, fmt.Errorf("unknown address style %q", style)
+}
+
+// WithPrefix returns a generator that prepends prefix and a hyphen to the local part of
+// every address produced by generate
+func WithPrefix(generate AddressGenerator, prefix string) AddressGenerator {
+	return func(domain string) (string, error) {
+		address, err := generate(domain)
+		if err != nil || prefix == "" {
+			return address, err
+		}
+		return strings.ToLower(prefix) + "-" + address, nil
+	}
+}
+
+// PassphraseGenerator returns a generator for memorable addresses made of the given
+// number of words and no number, e.g. correct-horse-battery@domain
+func PassphraseGenerator(words int) AddressGenerator {
+	words = max(words, 2)
+	wordlist := append(append([]string{}, adjectives...), nouns...)
+
+	return func(domain string) (string, error) {
+		parts := make([]string, words)
+		for i := range parts {
+			idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(wordlist))))
+			if err != nil {
+				return "", fmt.Errorf("failed to generate random word: %w", err)
+			}
+			parts[i] = wordlist[idx.Int64()]
+		}
+		return strings.ToLower(strings.Join(parts, "-") + "@" + domain), nil
+	}
+}
+
+// NormalizeAddress lowercases an address and, when its domain is one of
+// dotInsensitiveDomains, removes dots from the local part so that foo.bar@domain
+// and foobar@domain match the same inbox
+func NormalizeAddress(address string, dotInsensitiveDomains []string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	local, domain := address[:at], address[at+1:]
+	for _, d := range dotInsensitiveDomains {
+		if strings.EqualFold(d, domain) {
+			return strings.ReplaceAll(local, ".", "") + "@" + domain
+		}
+	}
+	return address
+}
+
+// ValidAddressFormat reports whether address looks like local@domain: at most maxLength
+// bytes (0 = no limit), a local part of up to 64 letters, digits and ._+- characters, and
+// a domain of dot-separated labels made of letters, digits and hyphens
+func ValidAddressFormat(address string, maxLength int) bool {
+	if maxLength > 0 && len(address) > maxLength {
+		return false
+	}
+
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || local == "" || len(local) > 64 {
+		return false
+	}
+	for _, c := range local {
+		if !isAddressAlnum(c) && !strings.ContainsRune("._+-", c) {
+			return false
+		}
+	}
+	return ValidDomainFormat(domain)
+}
+
+// ValidDomainFormat reports whether domain is made of dot-separated labels of up to
+// 63 letters, digits and inner hyphens, with at most 253 bytes in total
+func ValidDomainFormat(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !isAddressAlnum(c) && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isAddressAlnum reports whether c is an ASCII letter or digit
+func isAddressAlnum(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
 // NewEmailAddress creates a new EmailAddress with the given domain and expiration duration
 func NewEmailAddress(domain string, expiresIn time.Duration) (*EmailAddress, error) {
-	address, err := GenerateEmailAddress(domain)
+	return NewEmailAddressWithGenerator(domain, expiresIn, GenerateEmailAddress)
+}
+
+// NewEmailAddressWithGenerator creates a new EmailAddress using the given address generator
+func NewEmailAddressWithGenerator(domain string, expiresIn time.Duration, generate AddressGenerator) (*EmailAddress, error) {
+	address, err := generate(domain)
 	if err != nil {
 		return nil, err
 	}
@@ -108,6 +251,38 @@ func NewEmailAddress(domain string, expiresIn time.Duration) (*EmailAddress, err
 	}, nil
 }
 
+// sessionTokenBytes is the number of random bytes in a session token
+const sessionTokenBytes = 32
+
+// NewSessionToken generates a random 32-byte hex session token identifying a client
+func NewSessionToken() (string, error) {
+	b := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidSessionTokenFormat reports whether token has the exact shape NewSessionToken
+// produces: 64 lowercase hex characters
+func ValidSessionTokenFormat(token string) bool {
+	if len(token) != hex.EncodedLen(sessionTokenBytes) {
+		return false
+	}
+	for _, c := range token {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// HashSessionToken returns the SHA-256 hex digest of a session token; only the hash is stored
+func HashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // IsExpired checks if the email address has expired
 func (e *EmailAddress) IsExpired() bool {
 	return time.Now().UTC().After(e.ExpiresAt)
@@ -131,15 +306,33 @@ func NewEmail(toAddress, fromAddress, subject, bodyPreview, bodyText, bodyHTML,
 	}
 }
 
+// Attachment dispositions
+const (
+	DispositionAttachment = "attachment"
+	DispositionInline     = "inline"
+)
+
+// Attachment storage tiers
+const (
+	StorageTierHot  = "hot"
+	StorageTierCold = "cold"
+)
+
 // NewAttachment creates a new Attachment instance
 func NewAttachment(emailID, filename, filepath string, size int64) *Attachment {
-	id := ulid.MustNew(ulid.Timestamp(time.Now().UTC()), rand.Reader)
-
 	return &Attachment{
-		ID:       id.String(),
+		ID:       NewAttachmentID(),
 		EmailID:  emailID,
 		Filename: filename,
 		Filepath: filepath,
 		Size:     size,
+
+		Disposition: DispositionAttachment,
+		StorageTier: StorageTierHot,
 	}
 }
+
+// NewAttachmentID generates a new ULID for an attachment
+func NewAttachmentID() string {
+	return ulid.MustNew(ulid.Timestamp(time.Now().UTC()), rand.Reader).String()
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	dotInsensitive := []string{"Dots.Example"}
+
+	tests := []struct {
+		name    string
+		address string
+		want    string
+	}{
+		{name: "lowercase", address: "Foo.Bar@Example.COM", want: "foo.bar@example.com"},
+		{name: "trims whitespace", address: "  foo@example.com\t", want: "foo@example.com"},
+		{name: "keeps dots on other domains", address: "foo.bar@example.com", want: "foo.bar@example.com"},
+		{name: "strips dots on listed domain", address: "f.o.o.bar@dots.example", want: "foobar@dots.example"},
+		{name: "listed domain matches case-insensitively", address: "Foo.Bar@DOTS.example", want: "foobar@dots.example"},
+		{name: "keeps plus tag", address: "Foo+Tag@Example.com", want: "foo+tag@example.com"},
+		{name: "plus tag on listed domain", address: "foo.bar+x.y@dots.example", want: "foobar+xy@dots.example"},
+		{name: "last at sign splits the domain", address: "a.b@c@dots.example", want: "ab@c@dots.example"},
+		{name: "subdomain is not listed", address: "foo.bar@sub.dots.example", want: "foo.bar@sub.dots.example"},
+		{name: "no at sign", address: "Foo.Bar", want: "foo.bar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeAddress(tt.address, dotInsensitive); got != tt.want {
+				t.Errorf("NormalizeAddress(%q) = %q, want %q", tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddressIdempotent(t *testing.T) {
+	for _, address := range []string{"Foo.Bar+Tag@Dots.Example", "Foo.Bar@Example.com"} {
+		once := NormalizeAddress(address, []string{"dots.example"})
+		if twice := NormalizeAddress(once, []string{"dots.example"}); twice != once {
+			t.Errorf("NormalizeAddress(%q) = %q, normalizing again gives %q", address, once, twice)
+		}
+	}
+}
+
+func TestValidAddressFormat(t *testing.T) {
+	local64 := strings.Repeat("a", 64)
+	label63 := strings.Repeat("b", 63)
+
+	tests := []struct {
+		name      string
+		address   string
+		maxLength int
+		want      bool
+	}{
+		{name: "simple", address: "user@example.com", maxLength: 254, want: true},
+		{name: "mixed case", address: "User.Name@Example.COM", maxLength: 254, want: true},
+		{name: "plus tag", address: "user+tag@example.com", maxLength: 254, want: true},
+		{name: "generated style", address: "quick-brown-fox-42@tmpemail.xyz", maxLength: 254, want: true},
+		{name: "single label domain", address: "user@localhost", maxLength: 254, want: true},
+		{name: "exactly max length", address: "a@" + strings.Repeat("c", 8), maxLength: 10, want: true},
+		{name: "one over max length", address: "a@" + strings.Repeat("c", 9), maxLength: 10, want: false},
+		{name: "no length limit", address: local64 + "@" + label63 + "." + label63 + ".com", maxLength: 0, want: true},
+		{name: "local part of 64", address: local64 + "@example.com", maxLength: 254, want: true},
+		{name: "local part of 65", address: local64 + "a@example.com", maxLength: 254, want: false},
+		{name: "label of 63", address: "user@" + label63 + ".com", maxLength: 254, want: true},
+		{name: "label of 64", address: "user@" + label63 + "b.com", maxLength: 254, want: false},
+		{name: "missing at", address: "userexample.com", maxLength: 254, want: false},
+		{name: "two at signs", address: "user@host@example.com", maxLength: 254, want: false},
+		{name: "empty local part", address: "@example.com", maxLength: 254, want: false},
+		{name: "empty domain", address: "user@", maxLength: 254, want: false},
+		{name: "empty label", address: "user@example..com", maxLength: 254, want: false},
+		{name: "trailing dot", address: "user@example.com.", maxLength: 254, want: false},
+		{name: "leading hyphen", address: "user@-example.com", maxLength: 254, want: false},
+		{name: "trailing hyphen", address: "user@example-.com", maxLength: 254, want: false},
+		{name: "space", address: "us er@example.com", maxLength: 254, want: false},
+		{name: "quote", address: `"user"@example.com`, maxLength: 254, want: false},
+		{name: "path traversal", address: "../etc@example.com", maxLength: 254, want: false},
+		{name: "non-ascii", address: "usér@example.com", maxLength: 254, want: false},
+		{name: "empty", address: "", maxLength: 254, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidAddressFormat(tt.address, tt.maxLength); got != tt.want {
+				t.Errorf("ValidAddressFormat(%q, %d) = %v, want %v", tt.address, tt.maxLength, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidSessionTokenFormat(t *testing.T) {
+	token, err := NewSessionToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidSessionTokenFormat(token) {
+		t.Errorf("ValidSessionTokenFormat(%q) = false for an issued token", token)
+	}
+
+	for _, token := range []string{"", "abc", token[:63], token + "0", strings.ToUpper(token), "g" + token[1:]} {
+		if ValidSessionTokenFormat(token) {
+			t.Errorf("ValidSessionTokenFormat(%q) = true, want false", token)
+		}
+	}
+}
+
+func TestNewAddressGenerator(t *testing.T) {
+	tests := []struct {
+		style string
+		words int
+		ok    bool
+	}{
+		{style: "readable", words: 0, ok: true},
+		{style: "passphrase", words: 2, ok: true},
+		{style: "passphrase", words: 5, ok: true},
+		{style: "passphrase", words: 1, ok: false},
+		{style: "passphrase", words: 0, ok: false},
+		{style: "fancy", words: 3, ok: false},
+		{style: "", words: 3, ok: false},
+	}
+
+	for _, tt := range tests {
+		generator, err := NewAddressGenerator(tt.style, tt.words)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewAddressGenerator(%q, %d) error = %v, want ok %v", tt.style, tt.words, err, tt.ok)
+			continue
+		}
+		if tt.ok {
+			if address, err := generator("example.com"); err != nil || !ValidAddressFormat(address, 254) {
+				t.Errorf("NewAddressGenerator(%q, %d) generated %q, %v", tt.style, tt.words, address, err)
+			}
+		}
+	}
+}
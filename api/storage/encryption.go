@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Encrypted file layout:
+//
+//	magic (5 bytes) | key ID (8 bytes) | nonce (12 bytes) | AES-GCM ciphertext + tag
+//
+// The key ID is derived from the key itself so files written under a previous
+// key can still be decrypted after rotation, as long as that key is configured
+// as an old key. Files without the magic prefix are treated as plaintext, which
+// keeps files written before encryption was enabled readable.
+//
+// The Email Service writes these files and the API Service reads them, so this
+// file is duplicated in both modules; changes must be applied to both copies
+// (email-service/storage/encryption.go and encryption_test.go alongside it).
+var encryptionMagic = []byte("TMPE\x01")
+
+const keyIDSize = 8
+
+// Cipher encrypts and decrypts stored files with AES-256-GCM
+type Cipher struct {
+	currentID []byte
+	aeads     map[string]cipher.AEAD // keyed by key ID
+}
+
+// ParseKey decodes a base64-encoded 32-byte AES-256 key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 encryption key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// NewCipher creates a cipher that encrypts with currentKey and can decrypt with currentKey or any of oldKeys
+func NewCipher(currentKey []byte, oldKeys [][]byte) (*Cipher, error) {
+	c := &Cipher{aeads: make(map[string]cipher.AEAD)}
+
+	for i, key := range append([][]byte{currentKey}, oldKeys...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCM: %w", err)
+		}
+		id := keyID(key)
+		if i == 0 {
+			c.currentID = id
+		}
+		c.aeads[string(id)] = aead
+	}
+
+	return c, nil
+}
+
+// keyID derives a short, non-secret identifier for a key
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+// Encrypt encrypts data with the current key
+func (c *Cipher) Encrypt(data []byte) ([]byte, error) {
+	aead := c.aeads[string(c.currentID)]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(encryptionMagic)+keyIDSize+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, encryptionMagic...)
+	out = append(out, c.currentID...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, nil), nil
+}
+
+// Decrypt decrypts data written by Encrypt. Data without the encryption header is returned unchanged.
+func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptionMagic) {
+		return data, nil
+	}
+	data = data[len(encryptionMagic):]
+
+	if len(data) < keyIDSize {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	aead, ok := c.aeads[string(data[:keyIDSize])]
+	if !ok {
+		return nil, errors.New("file was encrypted with an unknown key")
+	}
+	data = data[keyIDSize:]
+
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Store provides read access to email and attachment files written by the Email Service
+type Store struct {
+	basePath string
+	coldPath string  // Root of cold-tier attachments; empty when tiering is disabled
+	cipher   *Cipher // nil when encryption at rest is disabled
+}
+
+// NewStore creates a new store rooted at basePath
+func NewStore(basePath string, cipher *Cipher) *Store {
+	return NewStoreWithColdPath(basePath, "", cipher)
+}
+
+// NewStoreWithColdPath creates a new store rooted at basePath that reads cold-tier attachments from coldPath
+func NewStoreWithColdPath(basePath, coldPath string, cipher *Cipher) *Store {
+	return &Store{
+		basePath: basePath,
+		coldPath: coldPath,
+		cipher:   cipher,
+	}
+}
+
+// Resolve cleans a stored file path, resolving relative paths against the storage directory
+func (s *Store) Resolve(path string) string {
+	cleanPath := filepath.Clean(path)
+	if !filepath.IsAbs(cleanPath) {
+		cleanPath = filepath.Join(s.basePath, cleanPath)
+	}
+	return cleanPath
+}
+
+// ResolveTier cleans a stored attachment path, resolving relative paths against the
+// root of its storage tier
+func (s *Store) ResolveTier(path, tier string) string {
+	cleanPath := filepath.Clean(path)
+	if tier == "cold" && s.coldPath != "" && !filepath.IsAbs(cleanPath) {
+		return filepath.Join(s.coldPath, cleanPath)
+	}
+	return s.Resolve(cleanPath)
+}
+
+// Open opens a stored file for reading and returns its plaintext size.
+// Encrypted files are decrypted in memory; plaintext files are streamed from disk.
+func (s *Store) Open(path string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(s.Resolve(path))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if s.cipher == nil {
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to stat file: %w", err)
+		}
+		return file, stat.Size(), nil
+	}
+
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read file: %w", err)
+	}
+	plaintext, err := s.cipher.Decrypt(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), int64(len(plaintext)), nil
+}
+
+// ReadFile returns the plaintext contents of a stored file
+func (s *Store) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(s.Resolve(path))
+	if err != nil {
+		return nil, err
+	}
+	if s.cipher == nil {
+		return data, nil
+	}
+	return s.cipher.Decrypt(data)
+}
@@ -35,6 +35,10 @@ type Client struct {
 	// Buffered channel of outbound messages
 	send chan []byte
 
+	// resume requests replay of broadcasts after sinceSeq on registration
+	resume   bool
+	sinceSeq uint64
+
 	logger *slog.Logger
 }
 
@@ -0,0 +1,53 @@
+package websocket
+
+import "time"
+
+// bufferedEvent is a broadcast kept for clients that reconnect with since_seq
+type bufferedEvent struct {
+	seq  uint64
+	at   time.Time
+	data []byte
+}
+
+// eventBuffer holds the most recent broadcasts of one address, oldest first
+type eventBuffer struct {
+	events []bufferedEvent
+
+	// droppedThrough is the highest seq evicted from this buffer; clients
+	// resuming from an earlier seq may have missed events
+	droppedThrough uint64
+}
+
+// add appends an event, evicting the oldest ones beyond maxSize
+func (b *eventBuffer) add(event bufferedEvent, maxSize int) {
+	b.events = append(b.events, event)
+	if excess := len(b.events) - maxSize; excess > 0 {
+		b.droppedThrough = b.events[excess-1].seq
+		b.events = append(b.events[:0], b.events[excess:]...)
+	}
+}
+
+// prune evicts events received before cutoff
+func (b *eventBuffer) prune(cutoff time.Time) {
+	n := 0
+	for n < len(b.events) && b.events[n].at.Before(cutoff) {
+		n++
+	}
+	if n > 0 {
+		b.droppedThrough = b.events[n-1].seq
+		b.events = append(b.events[:0], b.events[n:]...)
+	}
+}
+
+// since returns the buffered events after seq, or ok=false if some may have been evicted
+func (b *eventBuffer) since(seq uint64) (events []bufferedEvent, ok bool) {
+	if seq < b.droppedThrough {
+		return nil, false
+	}
+	for i, event := range b.events {
+		if event.seq > seq {
+			return b.events[i:], true
+		}
+	}
+	return nil, true
+}
@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// seqs returns the seq of every event, in order
+func seqs(events []bufferedEvent) []uint64 {
+	out := make([]uint64, 0, len(events))
+	for _, event := range events {
+		out = append(out, event.seq)
+	}
+	return out
+}
+
+func TestEventBufferSinceAfterWrap(t *testing.T) {
+	// Five events through a buffer of three evicts seqs 1 and 2
+	buf := &eventBuffer{}
+	for seq := uint64(1); seq <= 5; seq++ {
+		buf.add(bufferedEvent{seq: seq, at: time.Now()}, 3)
+	}
+
+	tests := []struct {
+		name  string
+		since uint64
+		want  []uint64
+		ok    bool
+	}{
+		{name: "missed an evicted event", since: 0, ok: false},
+		{name: "missed the last evicted event", since: 1, ok: false},
+		{name: "saw the last evicted event", since: 2, want: []uint64{3, 4, 5}, ok: true},
+		{name: "inside the buffer", since: 3, want: []uint64{4, 5}, ok: true},
+		{name: "up to date", since: 5, want: []uint64{}, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, ok := buf.since(tt.since)
+			if ok != tt.ok {
+				t.Fatalf("since(%d) ok = %v, want %v", tt.since, ok, tt.ok)
+			}
+			if ok && !slices.Equal(seqs(events), tt.want) {
+				t.Errorf("since(%d) = %v, want %v", tt.since, seqs(events), tt.want)
+			}
+		})
+	}
+}
+
+func TestEventBufferPrune(t *testing.T) {
+	now := time.Now()
+	buf := &eventBuffer{}
+	buf.add(bufferedEvent{seq: 1, at: now.Add(-time.Hour)}, 10)
+	buf.add(bufferedEvent{seq: 2, at: now.Add(-time.Minute)}, 10)
+	buf.add(bufferedEvent{seq: 3, at: now}, 10)
+
+	buf.prune(now.Add(-30 * time.Minute))
+
+	if got := seqs(buf.events); !slices.Equal(got, []uint64{2, 3}) {
+		t.Fatalf("events after prune = %v, want [2 3]", got)
+	}
+	if _, ok := buf.since(0); ok {
+		t.Error("since(0) ok after pruning seq 1, want resync")
+	}
+	if events, ok := buf.since(1); !ok || !slices.Equal(seqs(events), []uint64{2, 3}) {
+		t.Errorf("since(1) = %v, %v; want [2 3], true", seqs(events), ok)
+	}
+}
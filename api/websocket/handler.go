@@ -1,13 +1,19 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 
+	"tmpemail_api/config"
 	"tmpemail_api/database"
 	"tmpemail_api/middleware"
+	"tmpemail_api/models"
 )
 
 var upgrader = websocket.Upgrader{
@@ -25,6 +31,7 @@ type Handler struct {
 	db          *database.DB
 	logger      *slog.Logger
 	rateLimiter *middleware.RateLimiter
+	config      *config.Config
 }
 
 // NewHandler creates a new WebSocket handler
@@ -47,6 +54,18 @@ func NewHandlerWithRateLimiter(hub *Hub, db *database.DB, logger *slog.Logger, r
 	}
 }
 
+// NewHandlerWithConfig creates a new WebSocket handler with rate limiting that
+// reports the configured storage quota in the address_info message
+func NewHandlerWithConfig(hub *Hub, db *database.DB, cfg *config.Config, logger *slog.Logger, rateLimiter *middleware.RateLimiter) *Handler {
+	return &Handler{
+		hub:         hub,
+		db:          db,
+		logger:      logger,
+		rateLimiter: rateLimiter,
+		config:      cfg,
+	}
+}
+
 // ServeWS handles WebSocket requests from clients
 func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
 	// Check rate limit if configured
@@ -65,21 +84,37 @@ func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing address parameter", http.StatusBadRequest)
 		return
 	}
+	if h.config != nil && h.config.ValidateAddressFormat && !models.ValidAddressFormat(address, h.config.MaxAddressLength) {
+		http.Error(w, "Invalid address format", http.StatusBadRequest)
+		return
+	}
+
+	// Optional since_seq resumes after the last broadcast the client saw
+	var sinceSeq uint64
+	resume := false
+	if since := r.URL.Query().Get("since_seq"); since != "" {
+		seq, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since_seq parameter", http.StatusBadRequest)
+			return
+		}
+		sinceSeq, resume = seq, true
+	}
 
 	// Validate that address exists and is not expired
-	valid, expired, err := h.db.IsValidAddress(address)
+	addr, err := h.db.GetAddressContext(r.Context(), address)
 	if err != nil {
 		h.logger.Error("Failed to validate address for WebSocket", "error", err, "address", address)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if !valid {
+	if addr == nil {
 		http.Error(w, "Email address not found", http.StatusNotFound)
 		return
 	}
 
-	if expired {
+	if addr.IsExpired() {
 		http.Error(w, "Email address has expired", http.StatusGone)
 		return
 	}
@@ -93,6 +128,14 @@ func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
 
 	// Create new client
 	client := NewClient(conn, h.hub, address, h.logger)
+	client.resume, client.sinceSeq = resume, sinceSeq
+
+	// Queue address_info so it is the first message the client receives
+	if info, err := json.Marshal(h.addressInfo(r.Context(), addr)); err != nil {
+		h.logger.Error("Failed to marshal address info", "error", err, "address", address)
+	} else {
+		client.send <- info
+	}
 
 	// Register client with hub
 	h.hub.register <- client
@@ -102,3 +145,28 @@ func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
 
 	h.logger.Info("WebSocket connection established", "address", address)
 }
+
+// addressInfo builds the address_info message with the address's lifetime and storage usage
+func (h *Handler) addressInfo(ctx context.Context, addr *models.EmailAddress) Message {
+	data := map[string]interface{}{
+		"address":     addr.Address,
+		"created_at":  addr.CreatedAt.UTC().Format(time.RFC3339),
+		"expires_at":  addr.ExpiresAt.UTC().Format(time.RFC3339),
+		"server_time": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	storageUsed, err := h.db.GetStorageUsedByAddressContext(ctx, addr.Address)
+	if err != nil {
+		h.logger.Error("Failed to get storage used", "error", err, "address", addr.Address)
+	} else {
+		data["storage_used"] = storageUsed
+	}
+	if h.config != nil {
+		data["storage_quota"] = h.config.StorageQuotaPerAddress
+	}
+
+	return Message{
+		Type: "address_info",
+		Data: data,
+	}
+}
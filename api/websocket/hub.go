@@ -3,12 +3,17 @@ package websocket
 import (
 	"encoding/json"
 	"log/slog"
+	"runtime/debug"
 	"sync"
+	"time"
+
+	"tmpemail_api/config"
 )
 
 // Message represents a WebSocket message
 type Message struct {
 	Type string                 `json:"type"`
+	Seq  uint64                 `json:"seq,omitempty"` // Set on broadcasts; reconnect with since_seq to catch up
 	Data map[string]interface{} `json:"data"`
 }
 
@@ -29,6 +34,22 @@ type Hub struct {
 	// Mutex for thread-safe access to clients map
 	mu sync.RWMutex
 
+	// Recent broadcasts per address for clients resuming with since_seq.
+	// Only accessed from Run.
+	events       map[string]*eventBuffer
+	seq          uint64        // Last assigned seq; shared by all addresses so values never repeat
+	eventsFloor  uint64        // Highest seq of any buffer discarded once all its events expired
+	bufferSize   int           // Max buffered events per address (0 = no catch-up)
+	bufferMaxAge time.Duration // Buffered events older than this are dropped
+
+	// When each event type was last broadcast per address and email ID, for
+	// suppressing duplicates. Only accessed from Run.
+	recent      map[string]map[string]time.Time
+	dedupWindow time.Duration // Repeats within this window are dropped (0 = disabled)
+
+	// recoverPanics keeps Run alive when handling one event panics
+	recoverPanics bool
+
 	logger *slog.Logger
 }
 
@@ -40,76 +61,152 @@ type BroadcastMessage struct {
 
 // NewHub creates a new WebSocket hub
 func NewHub(logger *slog.Logger) *Hub {
+	return NewHubWithEventBuffer(logger, 0, 0)
+}
+
+// NewHubWithEventBuffer creates a new WebSocket hub that keeps up to bufferSize
+// broadcasts per address, for at most maxAge, so reconnecting clients can catch up
+func NewHubWithEventBuffer(logger *slog.Logger, bufferSize int, maxAge time.Duration) *Hub {
+	return NewHubWithDedup(logger, bufferSize, maxAge, 0)
+}
+
+// NewHubWithConfig creates a new WebSocket hub configured from the WebSocket settings
+func NewHubWithConfig(logger *slog.Logger, cfg *config.Config) *Hub {
+	h := NewHubWithDedup(logger, cfg.WSEventBufferSize, cfg.WSEventBufferMaxAge, cfg.WSDedupWindow)
+	h.recoverPanics = cfg.WSRecoverPanics
+	return h
+}
+
+// NewHubWithDedup creates a new WebSocket hub with an event buffer that also drops
+// a broadcast repeating the type and email ID of one sent to the same address within
+// dedupWindow, so an upstream double-fire never shows up twice in clients
+func NewHubWithDedup(logger *slog.Logger, bufferSize int, maxAge, dedupWindow time.Duration) *Hub {
 	return &Hub{
-		clients:    make(map[string]map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan BroadcastMessage, 256),
-		logger:     logger,
+		clients:      make(map[string]map[*Client]bool),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		broadcast:    make(chan BroadcastMessage, 256),
+		events:       make(map[string]*eventBuffer),
+		bufferSize:   bufferSize,
+		bufferMaxAge: maxAge,
+		recent:       make(map[string]map[string]time.Time),
+		dedupWindow:  dedupWindow,
+		logger:       logger,
+
+		recoverPanics: true,
 	}
 }
 
 // Run starts the hub and processes register/unregister/broadcast events
 func (h *Hub) Run() {
+	pruneTicker := time.NewTicker(time.Minute)
+	defer pruneTicker.Stop()
+
 	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			if h.clients[client.address] == nil {
-				h.clients[client.address] = make(map[*Client]bool)
-			}
-			h.clients[client.address][client] = true
-			h.mu.Unlock()
-			h.logger.Info("Client registered", "address", client.address)
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if clients, ok := h.clients[client.address]; ok {
-				if _, ok := clients[client]; ok {
-					delete(clients, client)
-					close(client.send)
-					if len(clients) == 0 {
-						delete(h.clients, client.address)
-					}
-				}
+		h.handleNext(pruneTicker.C)
+	}
+}
+
+// handleNext processes one hub event. With panic recovery enabled a panic is
+// logged and only drops that event, so one bad message or client cannot stop
+// real-time delivery for every address.
+func (h *Hub) handleNext(prune <-chan time.Time) {
+	if h.recoverPanics {
+		defer func() {
+			if err := recover(); err != nil {
+				h.logger.Error("Recovered from panic in WebSocket hub", "panic", err, "stack", string(debug.Stack()))
 			}
-			h.mu.Unlock()
-			h.logger.Info("Client unregistered", "address", client.address)
-
-		case broadcastMsg := <-h.broadcast:
-			h.mu.RLock()
-			clients := h.clients[broadcastMsg.Address]
-			h.mu.RUnlock()
-
-			if clients != nil {
-				// Convert message to JSON
-				messageBytes, err := json.Marshal(broadcastMsg.Message)
-				if err != nil {
-					h.logger.Error("Failed to marshal broadcast message", "error", err)
-					continue
-				}
-
-				// Send to all clients subscribed to this address
-				for client := range clients {
-					select {
-					case client.send <- messageBytes:
-					default:
-						// Client's send buffer is full, close the connection
-						h.mu.Lock()
-						close(client.send)
-						delete(clients, client)
-						if len(clients) == 0 {
-							delete(h.clients, broadcastMsg.Address)
-						}
-						h.mu.Unlock()
-						h.logger.Warn("Client send buffer full, closing connection", "address", client.address)
-					}
-				}
+		}()
+	}
+
+	select {
+	case client := <-h.register:
+		h.addClient(client)
+		h.logger.Info("Client registered", "address", client.address)
+
+		if client.resume {
+			h.replay(client)
+		}
+
+	case client := <-h.unregister:
+		h.removeClient(client)
+		h.logger.Info("Client unregistered", "address", client.address)
+
+	case <-prune:
+		h.pruneEvents()
+		h.pruneRecent()
+
+	case broadcastMsg := <-h.broadcast:
+		h.deliver(broadcastMsg)
+	}
+}
+
+// addClient subscribes a client to its address
+func (h *Hub) addClient(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[client.address] == nil {
+		h.clients[client.address] = make(map[*Client]bool)
+	}
+	h.clients[client.address][client] = true
+}
+
+// removeClient unsubscribes a client and closes its send channel if it is still registered
+func (h *Hub) removeClient(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if clients, ok := h.clients[client.address]; ok {
+		if _, ok := clients[client]; ok {
+			delete(clients, client)
+			close(client.send)
+			if len(clients) == 0 {
+				delete(h.clients, client.address)
 			}
 		}
 	}
 }
 
+// deliver assigns a broadcast its seq, buffers it and sends it to the address's clients
+func (h *Hub) deliver(broadcastMsg BroadcastMessage) {
+	if h.isDuplicate(broadcastMsg) {
+		h.logger.Info("Dropped duplicate broadcast",
+			"address", broadcastMsg.Address,
+			"type", broadcastMsg.Message.Type,
+			"id", broadcastMsg.Message.Data["id"],
+		)
+		return
+	}
+
+	h.seq++
+	broadcastMsg.Message.Seq = h.seq
+
+	// Convert message to JSON
+	messageBytes, err := json.Marshal(broadcastMsg.Message)
+	if err != nil {
+		h.logger.Error("Failed to marshal broadcast message", "error", err)
+		return
+	}
+	h.bufferEvent(broadcastMsg.Address, h.seq, messageBytes)
+
+	// Send to all clients subscribed to this address
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients[broadcastMsg.Address]))
+	for client := range h.clients[broadcastMsg.Address] {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		select {
+		case client.send <- messageBytes:
+		default:
+			// Client's send buffer is full, close the connection
+			h.removeClient(client)
+			h.logger.Warn("Client send buffer full, closing connection", "address", client.address)
+		}
+	}
+}
+
 // BroadcastToAddress sends a message to all clients subscribed to a specific address
 func (h *Hub) BroadcastToAddress(address string, message Message) {
 	h.broadcast <- BroadcastMessage{
@@ -124,3 +221,118 @@ func (h *Hub) GetClientCount(address string) int {
 	defer h.mu.RUnlock()
 	return len(h.clients[address])
 }
+
+// isDuplicate reports whether a broadcast of the same type for the same email ID
+// reached the address within dedupWindow, recording the broadcast otherwise.
+// Messages without a string "id" in their data are never duplicates.
+func (h *Hub) isDuplicate(msg BroadcastMessage) bool {
+	if h.dedupWindow <= 0 {
+		return false
+	}
+	id, ok := msg.Message.Data["id"].(string)
+	if !ok || id == "" {
+		return false
+	}
+
+	key := msg.Message.Type + ":" + id
+	now := time.Now()
+	recent := h.recent[msg.Address]
+	if at, ok := recent[key]; ok && now.Sub(at) < h.dedupWindow {
+		return true
+	}
+	if recent == nil {
+		recent = make(map[string]time.Time)
+		h.recent[msg.Address] = recent
+	}
+	recent[key] = now
+	return false
+}
+
+// pruneRecent forgets broadcasts older than dedupWindow
+func (h *Hub) pruneRecent() {
+	cutoff := time.Now().Add(-h.dedupWindow)
+	for address, recent := range h.recent {
+		for key, at := range recent {
+			if at.Before(cutoff) {
+				delete(recent, key)
+			}
+		}
+		if len(recent) == 0 {
+			delete(h.recent, address)
+		}
+	}
+}
+
+// bufferEvent keeps a broadcast for clients that reconnect with since_seq
+func (h *Hub) bufferEvent(address string, seq uint64, data []byte) {
+	if h.bufferSize <= 0 {
+		return
+	}
+	buf := h.events[address]
+	if buf == nil {
+		// A discarded buffer for this address may have held events newer than
+		// anything a resuming client saw, so start from the conservative floor
+		buf = &eventBuffer{droppedThrough: h.eventsFloor}
+		h.events[address] = buf
+	}
+	buf.add(bufferedEvent{seq: seq, at: time.Now(), data: data}, h.bufferSize)
+}
+
+// pruneEvents drops buffered events older than bufferMaxAge and discards empty buffers
+func (h *Hub) pruneEvents() {
+	cutoff := time.Now().Add(-h.bufferMaxAge)
+	for address, buf := range h.events {
+		buf.prune(cutoff)
+		if len(buf.events) == 0 {
+			h.eventsFloor = max(h.eventsFloor, buf.droppedThrough)
+			delete(h.events, address)
+		}
+	}
+}
+
+// replay sends a resuming client the broadcasts it missed after its since_seq,
+// or resync_required when they are no longer all buffered
+func (h *Hub) replay(client *Client) {
+	events, ok := h.eventsSince(client.address, client.sinceSeq)
+	if ok && len(events) > cap(client.send)-len(client.send) {
+		ok = false
+	}
+
+	if !ok {
+		h.logger.Info("Client must resync", "address", client.address, "since_seq", client.sinceSeq, "latest_seq", h.seq)
+		resync, err := json.Marshal(Message{
+			Type: "resync_required",
+			Data: map[string]interface{}{
+				"since_seq":  client.sinceSeq,
+				"latest_seq": h.seq,
+			},
+		})
+		if err != nil {
+			h.logger.Error("Failed to marshal resync message", "error", err)
+			return
+		}
+		select {
+		case client.send <- resync:
+		default:
+		}
+		return
+	}
+
+	for _, event := range events {
+		client.send <- event.data
+	}
+	h.logger.Info("Replayed missed events", "address", client.address, "since_seq", client.sinceSeq, "count", len(events))
+}
+
+// eventsSince returns the buffered events of address after seq, or ok=false
+// if the client may have missed events that are no longer buffered
+func (h *Hub) eventsSince(address string, seq uint64) (events []bufferedEvent, ok bool) {
+	// A seq from before a restart or with catch-up disabled cannot be honored
+	if h.bufferSize <= 0 || seq > h.seq {
+		return nil, false
+	}
+	if buf := h.events[address]; buf != nil {
+		return buf.since(seq)
+	}
+	return nil, seq >= h.eventsFloor
+}
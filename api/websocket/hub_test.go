@@ -0,0 +1,129 @@
+package websocket
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestHub returns a hub with an event buffer that is driven directly, without Run
+func newTestHub(bufferSize int) *Hub {
+	return NewHubWithEventBuffer(slog.New(slog.NewTextHandler(io.Discard, nil)), bufferSize, time.Hour)
+}
+
+// resumingClient returns a client for address that asks for broadcasts after sinceSeq
+func resumingClient(hub *Hub, address string, sinceSeq uint64) *Client {
+	client := NewClient(nil, hub, address, hub.logger)
+	client.resume = true
+	client.sinceSeq = sinceSeq
+	return client
+}
+
+// received decodes every message waiting in the client's send channel
+func received(t *testing.T, client *Client) []Message {
+	t.Helper()
+	var messages []Message
+	for {
+		select {
+		case data := <-client.send:
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("invalid message %q: %v", data, err)
+			}
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+func broadcast(hub *Hub, address string, count int) {
+	for i := 0; i < count; i++ {
+		hub.deliver(BroadcastMessage{Address: address, Message: Message{Type: "new_email", Data: map[string]interface{}{}}})
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		bufferSize int
+		sinceSeq   uint64
+		wantSeqs   []uint64 // nil when a resync is expected
+	}{
+		{name: "replays missed events", bufferSize: 10, sinceSeq: 2, wantSeqs: []uint64{3, 4, 5}},
+		{name: "nothing missed", bufferSize: 10, sinceSeq: 5, wantSeqs: []uint64{}},
+		{name: "replays after wrap", bufferSize: 3, sinceSeq: 2, wantSeqs: []uint64{3, 4, 5}},
+		{name: "resync after wrap", bufferSize: 3, sinceSeq: 1},
+		{name: "resync for a seq from before a restart", bufferSize: 10, sinceSeq: 99},
+		{name: "resync with catch-up disabled", bufferSize: 0, sinceSeq: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newTestHub(tt.bufferSize)
+			broadcast(hub, "user@example.com", 5)
+
+			client := resumingClient(hub, "user@example.com", tt.sinceSeq)
+			hub.replay(client)
+			messages := received(t, client)
+
+			if tt.wantSeqs == nil {
+				if len(messages) != 1 || messages[0].Type != "resync_required" {
+					t.Fatalf("got %+v, want a single resync_required", messages)
+				}
+				if latest := messages[0].Data["latest_seq"]; latest != float64(5) {
+					t.Errorf("latest_seq = %v, want 5", latest)
+				}
+				return
+			}
+
+			got := make([]uint64, 0, len(messages))
+			for _, msg := range messages {
+				if msg.Type != "new_email" {
+					t.Fatalf("got %q message, want only replayed new_email", msg.Type)
+				}
+				got = append(got, msg.Seq)
+			}
+			if !slices.Equal(got, tt.wantSeqs) {
+				t.Errorf("replayed seqs = %v, want %v", got, tt.wantSeqs)
+			}
+		})
+	}
+}
+
+func TestHubReplayOtherAddressesDoNotCountAsMissed(t *testing.T) {
+	hub := newTestHub(2)
+	broadcast(hub, "user@example.com", 1)  // seq 1
+	broadcast(hub, "other@example.com", 5) // seqs 2-6 wrap other's buffer only
+
+	client := resumingClient(hub, "user@example.com", 1)
+	hub.replay(client)
+	if messages := received(t, client); len(messages) != 0 {
+		t.Errorf("got %+v, want nothing to replay", messages)
+	}
+}
+
+func TestHubReplayAfterBufferExpired(t *testing.T) {
+	hub := newTestHub(10)
+	broadcast(hub, "user@example.com", 3)
+
+	// Expire everything; the discarded buffer leaves a floor behind
+	hub.bufferMaxAge = -time.Second
+	hub.pruneEvents()
+
+	for _, tt := range []struct {
+		sinceSeq uint64
+		resync   bool
+	}{{sinceSeq: 2, resync: true}, {sinceSeq: 3, resync: false}} {
+		client := resumingClient(hub, "user@example.com", tt.sinceSeq)
+		hub.replay(client)
+		messages := received(t, client)
+		gotResync := len(messages) == 1 && messages[0].Type == "resync_required"
+		if gotResync != tt.resync {
+			t.Errorf("since_seq %d: got %+v, want resync = %v", tt.sinceSeq, messages, tt.resync)
+		}
+	}
+}
@@ -3,44 +3,114 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 )
 
+// InternalTokenHeader authenticates the Email Service to the API Service's internal routes
+const InternalTokenHeader = "X-Internal-Token"
+
+// TraceIDHeader carries the per-message trace ID to the API Service, which logs it with every related line
+const TraceIDHeader = "X-Request-ID"
+
 // APIClient handles communication with the API Service
 type APIClient struct {
-	baseURL    string
-	httpClient *http.Client
+	baseURL     string
+	internalKey string
+	httpClient  *http.Client
+	breaker     *CircuitBreaker // nil when the circuit breaker is disabled
 }
 
 // NewAPIClient creates a new API client
 func NewAPIClient(baseURL string) *APIClient {
+	return NewAPIClientWithInternalKey(baseURL, "")
+}
+
+// NewAPIClientWithInternalKey creates a new API client that sends internalKey in the
+// X-Internal-Token header (empty = no header)
+func NewAPIClientWithInternalKey(baseURL, internalKey string) *APIClient {
+	return NewAPIClientWithBreaker(baseURL, internalKey, nil)
+}
+
+// NewAPIClientWithBreaker creates a new API client that reports the outcome of every
+// request to breaker (nil = disabled)
+func NewAPIClientWithBreaker(baseURL, internalKey string, breaker *CircuitBreaker) *APIClient {
 	return &APIClient{
-		baseURL: baseURL,
+		baseURL:     baseURL,
+		internalKey: internalKey,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		breaker: breaker,
 	}
 }
 
+// Available reports whether the API Service is considered reachable, i.e. the
+// circuit breaker is not open
+func (c *APIClient) Available() bool {
+	return !c.breaker.Open()
+}
+
+// APIError is returned when the API Service answers with an unexpected status.
+// Transport failures (API unreachable, timeouts) are returned as plain errors.
+type APIError struct {
+	Op         string // "validation" or "store"
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s request to %s failed: %s - %s", e.Op, e.URL, e.Status, e.Body)
+}
+
+// Permanent reports whether retrying the request cannot succeed because the API
+// Service rejected the address itself (malformed or unknown)
+func (e *APIError) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// IsPermanent reports whether err is an APIError that retrying cannot fix.
+// Everything else, including API downtime and auth misconfiguration, is temporary.
+func IsPermanent(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Permanent()
+}
+
 // ValidationResponse represents the address validation response
 type ValidationResponse struct {
 	Valid        bool  `json:"valid"`
 	Expired      bool  `json:"expired"`
 	StorageUsed  int64 `json:"storage_used"`  // Current storage used in bytes
 	StorageQuota int64 `json:"storage_quota"` // Max storage allowed in bytes (0 = unlimited)
+	QuotaWarning bool  `json:"quota_warning"` // Usage has reached the API's warning percentage of the quota
 }
 
-// ValidateAddress checks if an email address is valid and not expired
-func (c *APIClient) ValidateAddress(address string) (*ValidationResponse, error) {
+// ValidateAddress checks if an email address is valid and not expired.
+// traceID is sent as TraceIDHeader when non-empty.
+func (c *APIClient) ValidateAddress(address, traceID string) (*ValidationResponse, error) {
+	validation, err := c.doValidateAddress(address, traceID)
+	c.breaker.record(err)
+	return validation, err
+}
+
+// doValidateAddress performs a single address validation request
+func (c *APIClient) doValidateAddress(address, traceID string) (*ValidationResponse, error) {
 	url := fmt.Sprintf("%s/internal/v1/email/%s/", c.baseURL, address)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
+	c.setHeaders(req, traceID)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -50,7 +120,7 @@ func (c *APIClient) ValidateAddress(address string) (*ValidationResponse, error)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("validation request to %s failed: %s - %s", url, resp.Status, string(body))
+		return nil, &APIError{Op: "validation", URL: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
 	}
 
 	var validation ValidationResponse
@@ -74,6 +144,15 @@ type StoreEmailRequest struct {
 	AttachmentPaths []string `json:"attachment_paths"`
 	AttachmentNames []string `json:"attachment_names"`
 	AttachmentSizes []int64  `json:"attachment_sizes"`
+
+	// AttachmentDispositions is parallel to AttachmentPaths: "attachment" or "inline"
+	AttachmentDispositions []string `json:"attachment_dispositions,omitempty"`
+
+	// AttachmentContentIDs is parallel to AttachmentPaths; inline parts are referenced from the HTML as cid:<id>
+	AttachmentContentIDs []string `json:"attachment_content_ids,omitempty"`
+
+	// AttachmentTiers is parallel to AttachmentPaths: "hot" or "cold"
+	AttachmentTiers []string `json:"attachment_tiers,omitempty"`
 }
 
 // StoreEmailResponse represents the store email response
@@ -83,8 +162,10 @@ type StoreEmailResponse struct {
 	EmailID string `json:"email_id,omitempty"`
 }
 
-// StoreEmail sends email metadata to the API Service with retry logic
-func (c *APIClient) StoreEmail(address string, req *StoreEmailRequest) (*StoreEmailResponse, error) {
+// StoreEmail sends email metadata to the API Service, retrying transport failures
+// and temporary API errors with backoff. Permanent errors are returned at once.
+// traceID is sent as TraceIDHeader on every attempt when non-empty.
+func (c *APIClient) StoreEmail(address, traceID string, req *StoreEmailRequest) (*StoreEmailResponse, error) {
 	maxRetries := 3
 	var lastErr error
 
@@ -95,10 +176,15 @@ func (c *APIClient) StoreEmail(address string, req *StoreEmailRequest) (*StoreEm
 			time.Sleep(backoff)
 		}
 
-		resp, err := c.doStoreEmail(address, req)
+		resp, err := c.doStoreEmail(address, traceID, req)
+		c.breaker.record(err)
 		if err == nil {
 			return resp, nil
 		}
+		// The API rejected the address itself; backing off would only delay DATA
+		if IsPermanent(err) {
+			return nil, err
+		}
 
 		lastErr = err
 	}
@@ -107,7 +193,7 @@ func (c *APIClient) StoreEmail(address string, req *StoreEmailRequest) (*StoreEm
 }
 
 // doStoreEmail performs a single store email request
-func (c *APIClient) doStoreEmail(address string, req *StoreEmailRequest) (*StoreEmailResponse, error) {
+func (c *APIClient) doStoreEmail(address, traceID string, req *StoreEmailRequest) (*StoreEmailResponse, error) {
 	url := fmt.Sprintf("%s/internal/v1/email/%s/store", c.baseURL, address)
 
 	jsonData, err := json.Marshal(req)
@@ -120,6 +206,7 @@ func (c *APIClient) doStoreEmail(address string, req *StoreEmailRequest) (*Store
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
+	c.setHeaders(httpReq, traceID)
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
@@ -130,7 +217,7 @@ func (c *APIClient) doStoreEmail(address string, req *StoreEmailRequest) (*Store
 	body, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("store request failed: %s - %s", resp.Status, string(body))
+		return nil, &APIError{Op: "store", URL: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
 	}
 
 	var storeResp StoreEmailResponse
@@ -144,3 +231,13 @@ func (c *APIClient) doStoreEmail(address string, req *StoreEmailRequest) (*Store
 
 	return &storeResp, nil
 }
+
+// setHeaders adds the internal auth and trace ID headers to req when they are set
+func (c *APIClient) setHeaders(req *http.Request, traceID string) {
+	if c.internalKey != "" {
+		req.Header.Set(InternalTokenHeader, c.internalKey)
+	}
+	if traceID != "" {
+		req.Header.Set(TraceIDHeader, traceID)
+	}
+}
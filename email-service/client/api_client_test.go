@@ -0,0 +1,63 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// storeServer answers store requests with statuses in order, repeating the last one,
+// and counts the requests it received
+func storeServer(t *testing.T, statuses ...int) (*APIClient, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		json.NewEncoder(w).Encode(StoreEmailResponse{Success: true, EmailID: "id"})
+	}))
+	t.Cleanup(server.Close)
+	return NewAPIClient(server.URL), &calls
+}
+
+func TestStoreEmailPermanentErrorNotRetried(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusGone} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			c, calls := storeServer(t, status)
+
+			start := time.Now()
+			_, err := c.StoreEmail("user@example.com", "", &StoreEmailRequest{})
+			if !IsPermanent(err) {
+				t.Fatalf("StoreEmail error = %v, want a permanent error", err)
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("got %d store requests, want 1", n)
+			}
+			if elapsed := time.Since(start); elapsed >= time.Second {
+				t.Errorf("StoreEmail took %s, want no backoff", elapsed)
+			}
+		})
+	}
+}
+
+func TestStoreEmailRetriesTemporaryError(t *testing.T) {
+	c, calls := storeServer(t, http.StatusServiceUnavailable, http.StatusOK)
+
+	resp, err := c.StoreEmail("user@example.com", "", &StoreEmailRequest{})
+	if err != nil {
+		t.Fatalf("StoreEmail error: %v", err)
+	}
+	if resp.EmailID != "id" {
+		t.Errorf("EmailID = %q, want %q", resp.EmailID, "id")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("got %d store requests, want 2", n)
+	}
+}
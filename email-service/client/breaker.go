@@ -0,0 +1,58 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker tracks consecutive API Service failures. It opens after threshold
+// transient failures in a row and stays open for cooldown; afterwards a single
+// further failure reopens it until a request succeeds. Requests are never blocked
+// by the breaker itself, its state is only a signal for load shedding.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// NewCircuitBreaker creates a breaker that opens after threshold consecutive failures
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Open reports whether the breaker is open. A nil breaker is always closed.
+func (b *CircuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil)
+}
+
+// record updates the breaker with the outcome of a request. Permanent errors mean
+// the API answered, so they count as a success.
+func (b *CircuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || IsPermanent(err) {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds the email service configuration
@@ -15,13 +17,19 @@ type Config struct {
 	HealthPort string
 
 	// Storage
-	StoragePath string
+	StoragePath        string
+	DomainStoragePaths map[string]string // Recipient domain -> storage root; other domains use StoragePath
+
+	// Storage tiering: large attachments go to a separate cold path
+	ColdStoragePath      string // Root for attachments above ColdStorageThreshold (empty = disabled)
+	ColdStorageThreshold int    // Attachments larger than this many bytes are stored cold
 
 	// API Service
 	APIServiceURL string
 
 	// Email limits
 	MaxEmailSize int // in bytes
+	MaxMIMEDepth int // Max multipart nesting depth (0 = unlimited)
 
 	// TLS Settings
 	TLSEnabled  bool   // Enable TLS/STARTTLS
@@ -33,6 +41,55 @@ type Config struct {
 	ValidateDKIM  bool   // Enable DKIM signature verification
 	ValidateDMARC bool   // Enable DMARC policy checking
 	AuthPolicy    string // Policy for failed validation: "none" (log only), "reject" (reject email)
+
+	// Attachment storage
+	PreserveAttachmentPaths bool // Keep directory structure of path-like attachment names
+
+	// Multi-recipient delivery
+	ShareEMLAcrossRecipients bool // Store one .eml (and attachments) referenced by every recipient's email row
+
+	// Delivery failures
+	BouncePolicy string // "silent" (accept and drop undeliverable mail) or "reject" (return SMTP codes so the sender bounces)
+
+	// Encryption at rest
+	EncryptionKey     string   // Base64-encoded 32-byte AES-256 key (empty = disabled)
+	EncryptionOldKeys []string // Previous keys, still accepted for decryption after rotation
+
+	// Malformed messages
+	MissingDatePolicy string // "accept" (store as-is), "synthesize" (add a Date header from the received time) or "reject"
+
+	// Attachment-to-body ratio spam heuristic
+	AttachmentRatioPolicy     string // "off", "log" (flag only) or "reject"
+	AttachmentRatioThreshold  int    // Flag when attachment bytes exceed body bytes by this factor
+	AttachmentRatioMinBytes   int    // Ignore messages whose attachments total less than this
+	AttachmentRatioMinSignals int    // Other spam signals (no subject, empty body, failed auth) required alongside the ratio
+
+	// Stored body caps; the full message stays in the .eml file
+	MaxBodyTextSize int // Max bytes of body_text sent to the API (0 = unlimited)
+	MaxBodyHTMLSize int // Max bytes of body_html sent to the API (0 = unlimited)
+
+	// Logging
+	RejectionLogPath string // File that additionally receives SMTP rejection events (empty = disabled)
+
+	// Internal API authentication
+	InternalAPIKey string // Shared key sent as X-Internal-Token (must match the API Service)
+
+	// DATA transfers buffer the whole message in memory; this bounds how many run at once
+	MaxConcurrentData int           // Max simultaneous DATA transfers (0 = unlimited)
+	DataSlotWait      time.Duration // How long a DATA command waits for a free slot before a 451
+
+	// Emails saved to disk whose metadata the API would not store
+	OnStoreFailure      string        // "keep" (leave the files), "delete", "dead-letter" (move to DeadLetterPath) or "retry"
+	DeadLetterPath      string        // Directory for dead-lettered emails (also used when retries are exhausted)
+	StoreRetryInterval  time.Duration // Delay between retries under the "retry" policy
+	StoreRetryAttempts  int           // Retries before an email is dead-lettered or deleted
+	StoreRetryQueueSize int           // Max emails waiting for a retry; overflow is handled as if retries were exhausted
+
+	// Load shedding: new sessions are refused with a 421 while any signal reports overload
+	MaxSessions         int           // Max concurrent SMTP sessions (0 = unlimited)
+	MinFreeDiskBytes    int           // Refuse sessions when a storage root has less free space (0 = disabled)
+	APIBreakerThreshold int           // Consecutive API Service failures that open the circuit breaker (0 = disabled)
+	APIBreakerCooldown  time.Duration // How long the open breaker refuses sessions before the API is tried again
 }
 
 // Load loads configuration from environment variables with defaults
@@ -44,6 +101,7 @@ func Load() *Config {
 		StoragePath:   getEnv("TMPEMAIL_STORAGE_PATH", "./mail"),
 		APIServiceURL: getEnv("TMPEMAIL_API_URL", "http://localhost:8080"),
 		MaxEmailSize:  getIntEnv("TMPEMAIL_MAX_EMAIL_SIZE", 20*1024*1024), // 20MB default
+		MaxMIMEDepth:  getIntEnv("TMPEMAIL_MAX_MIME_DEPTH", 10),
 		TLSEnabled:    getBoolEnv("TMPEMAIL_TLS_ENABLED", false),
 		TLSCertPath:   getEnv("TMPEMAIL_TLS_CERT_PATH", "./certs/smtp.crt"),
 		TLSKeyPath:    getEnv("TMPEMAIL_TLS_KEY_PATH", "./certs/smtp.key"),
@@ -51,7 +109,84 @@ func Load() *Config {
 		ValidateDKIM:  getBoolEnv("TMPEMAIL_VALIDATE_DKIM", false),
 		ValidateDMARC: getBoolEnv("TMPEMAIL_VALIDATE_DMARC", false),
 		AuthPolicy:    getEnv("TMPEMAIL_AUTH_POLICY", "none"), // "none" or "reject"
+
+		PreserveAttachmentPaths: getBoolEnv("TMPEMAIL_PRESERVE_ATTACHMENT_PATHS", false),
+
+		ShareEMLAcrossRecipients: getBoolEnv("TMPEMAIL_SHARE_EML_ACROSS_RECIPIENTS", false),
+
+		BouncePolicy: getEnv("TMPEMAIL_BOUNCE_POLICY", "silent"), // "silent" or "reject"
+
+		EncryptionKey:     getEnv("TMPEMAIL_ENCRYPTION_KEY", ""),
+		EncryptionOldKeys: getEnvList("TMPEMAIL_ENCRYPTION_OLD_KEYS", nil),
+
+		MissingDatePolicy: getEnv("TMPEMAIL_MISSING_DATE_POLICY", "accept"), // "accept", "synthesize" or "reject"
+
+		AttachmentRatioPolicy:     getEnv("TMPEMAIL_ATTACHMENT_RATIO_POLICY", "log"), // "off", "log" or "reject"
+		AttachmentRatioThreshold:  getIntEnv("TMPEMAIL_ATTACHMENT_RATIO_THRESHOLD", 100),
+		AttachmentRatioMinBytes:   getIntEnv("TMPEMAIL_ATTACHMENT_RATIO_MIN_BYTES", 64*1024), // 64KB default
+		AttachmentRatioMinSignals: getIntEnv("TMPEMAIL_ATTACHMENT_RATIO_MIN_SIGNALS", 1),
+
+		MaxBodyTextSize: getIntEnv("TMPEMAIL_MAX_BODY_TEXT_SIZE", 0),
+		MaxBodyHTMLSize: getIntEnv("TMPEMAIL_MAX_BODY_HTML_SIZE", 0),
+
+		RejectionLogPath: getEnv("TMPEMAIL_REJECTION_LOG_PATH", ""),
+
+		InternalAPIKey: getEnv("TMPEMAIL_INTERNAL_API_KEY", ""),
+
+		DomainStoragePaths: getEnvMap("TMPEMAIL_DOMAIN_STORAGE_PATHS", nil),
+
+		ColdStoragePath:      getEnv("TMPEMAIL_COLD_STORAGE_PATH", ""),
+		ColdStorageThreshold: getIntEnv("TMPEMAIL_COLD_STORAGE_THRESHOLD", 5*1024*1024), // 5MB default
+
+		MaxConcurrentData: getIntEnv("TMPEMAIL_MAX_CONCURRENT_DATA", 0),
+		DataSlotWait:      getDurationEnv("TMPEMAIL_DATA_SLOT_WAIT", 10*time.Second),
+
+		OnStoreFailure:      getEnv("TMPEMAIL_ON_STORE_FAILURE", "keep"), // "keep", "delete", "dead-letter" or "retry"
+		DeadLetterPath:      getEnv("TMPEMAIL_DEAD_LETTER_PATH", ""),
+		StoreRetryInterval:  getDurationEnv("TMPEMAIL_STORE_RETRY_INTERVAL", time.Minute),
+		StoreRetryAttempts:  getIntEnv("TMPEMAIL_STORE_RETRY_ATTEMPTS", 5),
+		StoreRetryQueueSize: getIntEnv("TMPEMAIL_STORE_RETRY_QUEUE_SIZE", 100),
+
+		MaxSessions:         getIntEnv("TMPEMAIL_MAX_SESSIONS", 0),
+		MinFreeDiskBytes:    getIntEnv("TMPEMAIL_MIN_FREE_DISK_BYTES", 0),
+		APIBreakerThreshold: getIntEnv("TMPEMAIL_API_BREAKER_THRESHOLD", 0),
+		APIBreakerCooldown:  getDurationEnv("TMPEMAIL_API_BREAKER_COOLDOWN", 30*time.Second),
+	}
+}
+
+// getEnvList retrieves a comma-separated list from environment variable or returns default
+func getEnvList(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		parts := strings.Split(value, ",")
+		result := make([]string, 0, len(parts))
+		for _, p := range parts {
+			if trimmed := strings.TrimSpace(p); trimmed != "" {
+				result = append(result, trimmed)
+			}
+		}
+		if len(result) > 0 {
+			return result
+		}
+	}
+	return defaultValue
+}
+
+// getEnvMap retrieves a comma-separated list of key=value pairs from environment
+// variable or returns default. Keys are lowercased; malformed pairs are skipped.
+func getEnvMap(key string, defaultValue map[string]string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range getEnvList(key, nil) {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			continue
+		}
+		result[k] = v
+	}
+	if len(result) == 0 {
+		return defaultValue
 	}
+	return result
 }
 
 // getBoolEnv retrieves a bool environment variable or returns a default value
@@ -79,3 +214,13 @@ func getIntEnv(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getDurationEnv retrieves a duration environment variable or returns a default value
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"tmpemail_email_service/storage"
+)
+
+// sheddingListener refuses connections while the backend is overloaded: the client
+// gets a 421 in place of the 220 greeting and the connection is closed, freeing
+// its resources at once (RFC 5321 section 3.1). Each accepted connection holds a
+// session slot until it is closed.
+type sheddingListener struct {
+	net.Listener
+	backend *Backend
+	domain  string
+}
+
+// newSheddingListener wraps l with the backend's load-shedding policy
+func newSheddingListener(l net.Listener, b *Backend, domain string) *sheddingListener {
+	return &sheddingListener{Listener: l, backend: b, domain: domain}
+}
+
+// Accept returns the next connection the backend can take, refusing the others
+func (l *sheddingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		reason := l.backend.admit()
+		if reason == "" {
+			return &sessionConn{Conn: conn, backend: l.backend}, nil
+		}
+
+		clientIP := ""
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			clientIP = tcpAddr.IP.String()
+		}
+		l.backend.rejectLogger.Warn("SMTP REJECT: Service overloaded",
+			"reason", reason,
+			"client_ip", clientIP,
+			"smtp_code", 421,
+		)
+		// A short deadline keeps a stalled client from blocking the accept loop
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(conn, "421 4.3.2 %s Service not available, try again later\r\n", l.domain)
+		conn.Close()
+	}
+}
+
+// sessionConn is an accepted connection that releases its session slot when closed
+type sessionConn struct {
+	net.Conn
+	backend *Backend
+	once    sync.Once
+}
+
+// Close closes the connection and releases its session slot
+func (c *sessionConn) Close() error {
+	c.once.Do(func() { c.backend.sessions.Add(-1) })
+	return c.Conn.Close()
+}
+
+// admit reserves a session slot and checks the other load-shedding signals. It
+// returns why a new session should be refused, or "" when the service can take it,
+// in which case the caller owns the slot. Refusing new connections lets senders
+// back off and retry instead of failing deep in DATA.
+func (b *Backend) admit() string {
+	// Reserve before comparing so concurrent sessions cannot all pass the check
+	if n := b.sessions.Add(1); b.config.MaxSessions > 0 && n > int64(b.config.MaxSessions) {
+		b.sessions.Add(-1)
+		return "session limit reached"
+	}
+	if reason := b.overloaded(); reason != "" {
+		b.sessions.Add(-1)
+		return reason
+	}
+	return ""
+}
+
+// capacity is admit without the reservation, for callers that only report whether a
+// new session would be accepted
+func (b *Backend) capacity() string {
+	if b.config.MaxSessions > 0 && b.sessions.Load() >= int64(b.config.MaxSessions) {
+		return "session limit reached"
+	}
+	return b.overloaded()
+}
+
+// overloaded checks the resource signals: free disk space and the API circuit breaker
+func (b *Backend) overloaded() string {
+	if b.config.MinFreeDiskBytes > 0 {
+		for _, root := range b.storage.Roots() {
+			free, err := storage.FreeSpace(root)
+			if err != nil {
+				// An unknown amount of free space never refuses mail
+				b.logger.Debug("Failed to check free disk space", "error", err, "path", root)
+				continue
+			}
+			if free < uint64(b.config.MinFreeDiskBytes) {
+				return "low disk space on " + root
+			}
+		}
+	}
+
+	if !b.apiClient.Available() {
+		return "API Service circuit breaker open"
+	}
+
+	return ""
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"tmpemail_email_service/config"
+)
+
+// greeting connects to addr and returns the first line the server sends
+func greeting(t *testing.T, addr string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading greeting: %v", err)
+	}
+	return conn, reader, line
+}
+
+func TestSheddingListenerRefusesAndClosesWhenOverloaded(t *testing.T) {
+	b := newTestBackend(t, &stubAPI{}, func(cfg *config.Config) { cfg.MaxSessions = 1 })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := smtp.NewServer(b)
+	server.Domain = "tmpemail.test"
+	go server.Serve(newSheddingListener(listener, b, server.Domain))
+	t.Cleanup(func() { server.Close() })
+	addr := listener.Addr().String()
+
+	first, _, line := greeting(t, addr)
+	if !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("first connection greeting = %q, want 220", line)
+	}
+
+	refused, reader, line := greeting(t, addr)
+	defer refused.Close()
+	if !strings.HasPrefix(line, "421 4.3.2 ") {
+		t.Fatalf("second connection greeting = %q, want 421", line)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("refused connection read after 421 = %v, want EOF (connection closed)", err)
+	}
+
+	// Closing the first connection frees its slot once the server notices
+	first.Write([]byte("QUIT\r\n"))
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.sessions.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := b.sessions.Load(); n != 0 {
+		t.Fatalf("session count after close = %d, want 0", n)
+	}
+
+	third, _, line := greeting(t, addr)
+	defer third.Close()
+	if !strings.HasPrefix(line, "220 ") {
+		t.Errorf("connection after a slot was freed greeting = %q, want 220", line)
+	}
+}
+
+func TestAdmitEnforcesMaxSessionsUnderConcurrency(t *testing.T) {
+	const maxSessions = 5
+	b := newTestBackend(t, &stubAPI{}, func(cfg *config.Config) { cfg.MaxSessions = maxSessions })
+
+	var admitted atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if b.admit() == "" {
+				admitted.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := admitted.Load(); n != maxSessions {
+		t.Errorf("admitted %d concurrent sessions, want %d", n, maxSessions)
+	}
+	if n := b.sessions.Load(); n != maxSessions {
+		t.Errorf("session count = %d, want %d", n, maxSessions)
+	}
+}
+
+func TestReadinessReportsCapacityWithoutTakingASlot(t *testing.T) {
+	b := newTestBackend(t, &stubAPI{}, func(cfg *config.Config) { cfg.MaxSessions = 1 })
+	health := NewHealthServer(b.apiClient, b.logger, b)
+	health.SetReady(true)
+
+	readiness := func() (int, readinessResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		health.ReadinessHandler(rec, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+		var resp readinessResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode readiness response: %v", err)
+		}
+		return rec.Code, resp
+	}
+
+	if code, resp := readiness(); code != http.StatusOK {
+		t.Fatalf("readiness with a free slot = %d %v, want 200", code, resp.Checks)
+	}
+	if n := b.sessions.Load(); n != 0 {
+		t.Fatalf("session count after readiness = %d, want 0", n)
+	}
+
+	if reason := b.admit(); reason != "" {
+		t.Fatalf("admit: %s", reason)
+	}
+	code, resp := readiness()
+	if code != http.StatusServiceUnavailable || resp.Checks["smtp_capacity"] == "ok" {
+		t.Errorf("readiness at the session limit = %d %v, want 503 with smtp_capacity failed", code, resp.Checks)
+	}
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -17,6 +21,7 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/emersion/go-msgauth/dkim"
@@ -31,18 +36,64 @@ import (
 
 // Backend implements SMTP backend
 type Backend struct {
-	storage   *storage.Storage
-	apiClient *client.APIClient
-	config    *config.Config
-	logger    *slog.Logger
+	storage      *storage.Storage
+	apiClient    *client.APIClient
+	config       *config.Config
+	logger       *slog.Logger
+	rejectLogger *slog.Logger     // Logs SMTP rejections with event=smtp_reject
+	dataSlots    chan struct{}    // Semaphore bounding concurrent DATA transfers (nil = unlimited)
+	storeRetries *storeRetryQueue // Background store retries (nil unless OnStoreFailure is "retry")
+	sessions     atomic.Int64     // Open SMTP connections, checked against MaxSessions
 }
 
-func NewBackend(storage *storage.Storage, apiClient *client.APIClient, cfg *config.Config, logger *slog.Logger) *Backend {
-	return &Backend{
-		storage:   storage,
-		apiClient: apiClient,
-		config:    cfg,
-		logger:    logger,
+// NewBackend creates the SMTP backend. SMTP rejection events are additionally
+// written to rejectionHandler when it is non-nil.
+func NewBackend(storage *storage.Storage, apiClient *client.APIClient, cfg *config.Config, logger *slog.Logger, rejectionHandler slog.Handler) *Backend {
+	rejectLogger := logger
+	if rejectionHandler != nil {
+		rejectLogger = slog.New(newTeeHandler(logger.Handler(), rejectionHandler))
+	}
+
+	var dataSlots chan struct{}
+	if cfg.MaxConcurrentData > 0 {
+		dataSlots = make(chan struct{}, cfg.MaxConcurrentData)
+	}
+
+	b := &Backend{
+		storage:      storage,
+		apiClient:    apiClient,
+		config:       cfg,
+		logger:       logger,
+		rejectLogger: rejectLogger.With("event", rejectionEvent),
+		dataSlots:    dataSlots,
+	}
+	if cfg.OnStoreFailure == "retry" {
+		b.storeRetries = newStoreRetryQueue(b)
+	}
+	return b
+}
+
+// acquireDataSlot waits up to DataSlotWait for a free DATA slot. It returns a
+// release func, or nil if no slot became free in time.
+func (b *Backend) acquireDataSlot() func() {
+	if b.dataSlots == nil {
+		return func() {}
+	}
+
+	release := func() { <-b.dataSlots }
+	select {
+	case b.dataSlots <- struct{}{}:
+		return release
+	default:
+	}
+
+	timer := time.NewTimer(b.config.DataSlotWait)
+	defer timer.Stop()
+	select {
+	case b.dataSlots <- struct{}{}:
+		return release
+	case <-timer.C:
+		return nil
 	}
 }
 
@@ -57,9 +108,10 @@ func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	}
 
 	return &Session{
-		backend:  b,
-		logger:   b.logger,
-		clientIP: clientIP,
+		backend:      b,
+		logger:       b.logger,
+		rejectLogger: b.rejectLogger,
+		clientIP:     clientIP,
 	}, nil
 }
 
@@ -72,16 +124,22 @@ type recipientInfo struct {
 
 // Session represents an SMTP session
 type Session struct {
-	backend    *Backend
-	from       string
-	recipients []recipientInfo
-	logger     *slog.Logger
-	clientIP   net.IP
+	backend      *Backend
+	from         string
+	recipients   []recipientInfo
+	logger       *slog.Logger
+	clientIP     net.IP
+	rejectLogger *slog.Logger
+	traceID      string      // Per-message ID, propagated to the API Service and logged on every line
+	authResult   *AuthResult // SPF/DKIM/DMARC outcome of the current message, nil when validation is disabled
 }
 
 // Mail is called when the MAIL FROM command is received
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	s.from = from
+	s.traceID = newTraceID()
+	s.logger = s.backend.logger.With("trace_id", s.traceID)
+	s.rejectLogger = s.backend.rejectLogger.With("trace_id", s.traceID)
 	s.logger.Info("MAIL FROM received",
 		"from", from,
 		"client_ip", s.clientIP.String(),
@@ -91,6 +149,7 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 
 // Rcpt is called when RCPT TO command is received
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	cfg := s.backend.config
 	s.logger.Info("RCPT TO received",
 		"to", to,
 		"from", s.from,
@@ -101,9 +160,24 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	address := extractEmailAddress(to)
 
 	// Validate address with API Service
-	validation, err := s.backend.apiClient.ValidateAddress(address)
+	validation, err := s.backend.apiClient.ValidateAddress(address, s.traceID)
+	if err != nil && client.IsPermanent(err) {
+		// The API rejected the address itself; retrying will not help
+		s.rejectLogger.Warn("SMTP REJECT: API rejected address",
+			"error", err,
+			"address", address,
+			"from", s.from,
+			"client_ip", s.clientIP.String(),
+			"smtp_code", 550,
+		)
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Recipient address rejected: User unknown",
+		}
+	}
 	if err != nil {
-		s.logger.Error("SMTP REJECT: Failed to validate address with API",
+		s.rejectLogger.Error("SMTP REJECT: Failed to validate address with API",
 			"error", err,
 			"address", address,
 			"from", s.from,
@@ -117,7 +191,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	}
 
 	if !validation.Valid {
-		s.logger.Warn("SMTP REJECT: Invalid email address (not found)",
+		s.rejectLogger.Warn("SMTP REJECT: Invalid email address (not found)",
 			"address", address,
 			"from", s.from,
 			"client_ip", s.clientIP.String(),
@@ -130,7 +204,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	}
 
 	if validation.Expired {
-		s.logger.Warn("SMTP REJECT: Expired email address",
+		s.rejectLogger.Warn("SMTP REJECT: Expired email address",
 			"address", address,
 			"from", s.from,
 			"client_ip", s.clientIP.String(),
@@ -142,10 +216,30 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		}
 	}
 
+	// With the reject bounce policy a recipient that is already at quota is refused
+	// permanently here so the sending MTA generates the bounce itself
+	if cfg.BouncePolicy == "reject" &&
+		validation.StorageQuota > 0 && validation.StorageUsed >= validation.StorageQuota {
+		s.rejectLogger.Warn("SMTP REJECT: Recipient mailbox full",
+			"address", address,
+			"from", s.from,
+			"storage_used", validation.StorageUsed,
+			"storage_quota", validation.StorageQuota,
+			"client_ip", s.clientIP.String(),
+			"smtp_code", 552,
+		)
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      "Recipient mailbox full",
+		}
+	}
+
 	s.logger.Info("Recipient accepted",
 		"address", address,
 		"storage_used", validation.StorageUsed,
 		"storage_quota", validation.StorageQuota,
+		"quota_warning", validation.QuotaWarning,
 	)
 
 	// Store recipient with quota info
@@ -159,8 +253,9 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 
 // Data is called when the DATA command is received
 func (s *Session) Data(r io.Reader) error {
+	cfg := s.backend.config
 	if len(s.recipients) == 0 {
-		s.logger.Warn("SMTP REJECT: No valid recipients",
+		s.rejectLogger.Warn("SMTP REJECT: No valid recipients",
 			"from", s.from,
 			"client_ip", s.clientIP.String(),
 			"smtp_code", 554,
@@ -171,6 +266,24 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	// Bound peak memory: every transfer below buffers up to MaxEmailSize
+	release := s.backend.acquireDataSlot()
+	if release == nil {
+		s.rejectLogger.Warn("SMTP REJECT: Too many concurrent DATA transfers",
+			"from", s.from,
+			"recipients", len(s.recipients),
+			"client_ip", s.clientIP.String(),
+			"max_concurrent_data", cfg.MaxConcurrentData,
+			"smtp_code", 451,
+		)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+			Message:      "Server busy, please try again later",
+		}
+	}
+	defer release()
+
 	s.logger.Info("DATA command received, reading email content",
 		"from", s.from,
 		"recipients", len(s.recipients),
@@ -178,10 +291,10 @@ func (s *Session) Data(r io.Reader) error {
 	)
 
 	// Read email data with size limit
-	limitReader := io.LimitReader(r, int64(s.backend.config.MaxEmailSize))
+	limitReader := io.LimitReader(r, int64(cfg.MaxEmailSize))
 	rawEmail, err := io.ReadAll(limitReader)
 	if err != nil {
-		s.logger.Error("SMTP REJECT: Failed to read email data",
+		s.rejectLogger.Error("SMTP REJECT: Failed to read email data",
 			"error", err,
 			"from", s.from,
 			"recipients", len(s.recipients),
@@ -195,14 +308,14 @@ func (s *Session) Data(r io.Reader) error {
 	}
 
 	// Check if email exceeds size limit
-	if len(rawEmail) >= s.backend.config.MaxEmailSize {
+	if len(rawEmail) >= cfg.MaxEmailSize {
 		recipientAddrs := make([]string, len(s.recipients))
 		for i, r := range s.recipients {
 			recipientAddrs[i] = r.address
 		}
-		s.logger.Warn("SMTP REJECT: Email exceeds size limit",
+		s.rejectLogger.Warn("SMTP REJECT: Email exceeds size limit",
 			"size", len(rawEmail),
-			"max_size", s.backend.config.MaxEmailSize,
+			"max_size", cfg.MaxEmailSize,
 			"from", s.from,
 			"to", recipientAddrs,
 			"client_ip", s.clientIP.String(),
@@ -214,6 +327,7 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	receivedAt := time.Now()
 	emailSize := int64(len(rawEmail))
 	recipientAddrs := make([]string, len(s.recipients))
 	for i, r := range s.recipients {
@@ -227,14 +341,48 @@ func (s *Session) Data(r io.Reader) error {
 		"client_ip", s.clientIP.String(),
 	)
 
+	// Reject maliciously nested MIME structures before the full parse
+	if mimeDepthExceeds(rawEmail, cfg.MaxMIMEDepth) {
+		s.rejectLogger.Warn("SMTP REJECT: MIME nesting exceeds maximum depth",
+			"max_depth", cfg.MaxMIMEDepth,
+			"size", len(rawEmail),
+			"from", s.from,
+			"to", recipientAddrs,
+			"client_ip", s.clientIP.String(),
+			"smtp_code", 552,
+		)
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Email rejected: MIME structure nested too deeply",
+		}
+	}
+
+	// Handle messages without a Date header according to policy
+	missingDate := cfg.MissingDatePolicy != "accept" && !hasDateHeader(rawEmail)
+	if missingDate && cfg.MissingDatePolicy == "reject" {
+		s.rejectLogger.Warn("SMTP REJECT: Email has no Date header",
+			"from", s.from,
+			"to", recipientAddrs,
+			"client_ip", s.clientIP.String(),
+			"policy", cfg.MissingDatePolicy,
+			"smtp_code", 550,
+		)
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Email rejected: missing Date header",
+		}
+	}
+
 	// Perform email authentication validation (SPF/DKIM/DMARC)
-	cfg := s.backend.config
 	if cfg.ValidateSPF || cfg.ValidateDKIM || cfg.ValidateDMARC {
 		authResult := s.validateEmailAuth(rawEmail)
+		s.authResult = authResult
 
 		// Check if we should reject the email based on policy
 		if s.shouldRejectEmail(authResult) {
-			s.logger.Warn("SMTP REJECT: Email authentication failed",
+			s.rejectLogger.Warn("SMTP REJECT: Email authentication failed",
 				"from", s.from,
 				"to", recipientAddrs,
 				"client_ip", s.clientIP.String(),
@@ -251,8 +399,28 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
-	// Process email for each recipient (check quota first)
+	// Synthesize the Date header only after DKIM has verified the original bytes
+	if missingDate && cfg.MissingDatePolicy == "synthesize" {
+		rawEmail = withDateHeader(rawEmail, receivedAt)
+		emailSize = int64(len(rawEmail))
+		s.logger.Info("Added missing Date header",
+			"from", s.from,
+			"to", recipientAddrs,
+			"date", receivedAt.Format(time.RFC1123Z),
+		)
+	}
+
+	// Process email for each recipient (check quota first).
+	// Every recipient gets its own stored email even though the Message-ID is shared:
+	// deliveries to different addresses are distinct, so any Message-ID dedup must be
+	// keyed by recipient address, never global.
 	successCount := 0
+	quotaExceededCount := 0
+	// On-disk copies reused across recipients when sharing is enabled, one per storage root
+	shared := make(map[string]*savedMessage)
+	// Saved files the API did not store are handled once every recipient has been tried,
+	// so files shared with a recipient that was stored are never removed
+	var storeFailures []storeFailure
 	for _, rcpt := range s.recipients {
 		// Check storage quota (0 = unlimited)
 		if rcpt.storageQuota > 0 && rcpt.storageUsed+emailSize > rcpt.storageQuota {
@@ -266,10 +434,57 @@ func (s *Session) Data(r io.Reader) error {
 				"client_ip", s.clientIP.String(),
 			)
 			// Skip this recipient but continue with others
+			quotaExceededCount++
 			continue
 		}
 
-		if err := s.processEmail(rcpt.address, rawEmail); err != nil {
+		var saved *savedMessage
+		var err error
+		if cfg.ShareEMLAcrossRecipients {
+			// Save once per storage root so tenants never reference each other's files;
+			// a failed save is retried by the next recipient with the same root
+			root := s.backend.storage.Root(rcpt.address)
+			saved = shared[root]
+			if saved == nil {
+				saved, err = s.saveMessage(rcpt.address, rawEmail)
+				shared[root] = saved
+			}
+		} else {
+			saved, err = s.saveMessage(rcpt.address, rawEmail)
+		}
+		if err == nil {
+			// A failed store is not a delivery. TMPEMAIL_ON_STORE_FAILURE decides after the
+			// loop what happens to its files, and a queued retry counts as delivered. When
+			// no recipient was stored or queued, the "reject" bounce policy answers 451 so
+			// the sender retries, while "silent" still accepts the email.
+			if err = s.storeMessage(rcpt.address, rawEmail, saved); err != nil {
+				saved.holders.Add(1)
+				storeFailures = append(storeFailures, storeFailure{
+					address: rcpt.address,
+					msg:     saved,
+					req:     newStoreRequest(rcpt.address, nil, saved),
+					err:     err,
+				})
+			} else {
+				saved.retained.Store(true)
+			}
+		}
+
+		if errors.Is(err, errSuspiciousAttachmentRatio) {
+			// The content is the same for every recipient, so reject the whole message
+			s.rejectLogger.Warn("SMTP REJECT: Attachment-to-body ratio heuristic",
+				"from", s.from,
+				"to", recipientAddrs,
+				"client_ip", s.clientIP.String(),
+				"smtp_code", 550,
+			)
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Email rejected: suspected spam",
+			}
+		}
+		if err != nil {
 			s.logger.Error("Failed to process email for recipient",
 				"error", err,
 				"to", rcpt.address,
@@ -282,6 +497,12 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	for _, f := range storeFailures {
+		if s.handleStoreFailure(f) {
+			successCount++
+		}
+	}
+
 	s.logger.Info("Email processing completed",
 		"from", s.from,
 		"total_recipients", len(s.recipients),
@@ -290,35 +511,69 @@ func (s *Session) Data(r io.Reader) error {
 		"client_ip", s.clientIP.String(),
 	)
 
+	// SMTP has a single reply for DATA, so a partial delivery must still be accepted.
+	// When nothing was delivered the reject policy reports the real outcome instead
+	// of a false "accepted": permanent for quota, temporary for storage failures.
+	if successCount == 0 && cfg.BouncePolicy == "reject" {
+		if quotaExceededCount == len(s.recipients) {
+			s.rejectLogger.Warn("SMTP REJECT: Storage quota exceeded for all recipients",
+				"from", s.from,
+				"to", recipientAddrs,
+				"client_ip", s.clientIP.String(),
+				"smtp_code", 552,
+			)
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+				Message:      "Recipient mailbox full",
+			}
+		}
+		s.rejectLogger.Warn("SMTP REJECT: Email could not be stored for any recipient",
+			"from", s.from,
+			"to", recipientAddrs,
+			"client_ip", s.clientIP.String(),
+			"smtp_code", 451,
+		)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure storing message",
+		}
+	}
+
 	return nil
 }
 
-// processEmail handles storing and notifying the API about a new email
-func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
+// savedMessage holds the on-disk location and parsed content of a stored email
+type savedMessage struct {
+	filePath        string
+	from            string
+	subject         string
+	bodyText        string
+	bodyHTML        string
+	attachmentPaths []string
+	attachmentNames []string
+	attachmentSizes []int64
+
+	attachmentDispositions []string // "attachment" or "inline", parallel to attachmentPaths
+	attachmentContentIDs   []string // Content-ID without angle brackets (may be empty), parallel to attachmentPaths
+	attachmentTiers        []string // Storage tier ("hot" or "cold"), parallel to attachmentPaths
+
+	// The files may be shared by several recipients. retained is set once any of them
+	// was stored; holders counts the failed recipients still deciding what happens to
+	// the files (including queued retries). The last holder to give up discards them.
+	retained atomic.Bool
+	holders  atomic.Int32
+}
+
+// saveMessage writes the raw email and its attachments to the filesystem and parses its content
+func (s *Session) saveMessage(toAddress string, rawEmail []byte) (*savedMessage, error) {
 	s.logger.Info("Processing email for recipient",
 		"to", toAddress,
 		"from", s.from,
 		"size_bytes", len(rawEmail),
 	)
 
-	// Save email to filesystem
-	filePath, err := s.backend.storage.SaveEmail(toAddress, rawEmail)
-	if err != nil {
-		s.logger.Error("Failed to save email to filesystem",
-			"error", err,
-			"to", toAddress,
-			"from", s.from,
-			"size_bytes", len(rawEmail),
-		)
-		return fmt.Errorf("failed to save email: %w", err)
-	}
-
-	s.logger.Info("Email saved to filesystem",
-		"path", filePath,
-		"to", toAddress,
-		"from", s.from,
-	)
-
 	// Parse email using enmime - much more robust MIME parsing
 	env, err := enmime.ReadEnvelope(bytes.NewReader(rawEmail))
 	if err != nil {
@@ -358,10 +613,54 @@ func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
 	bodyText := env.Text
 	bodyHTML := env.HTML
 
+	// Checked before anything is written so a rejected message leaves no files behind
+	if s.checkAttachmentRatio(env, toAddress) {
+		return nil, errSuspiciousAttachmentRatio
+	}
+
+	// Cap the bodies stored in the database; the .eml keeps the full content
+	if truncated, ok := truncateBody(bodyText, s.backend.config.MaxBodyTextSize, textTruncationMarker); ok {
+		s.logger.Info("Truncated text body for storage",
+			"original_bytes", len(bodyText),
+			"max_bytes", s.backend.config.MaxBodyTextSize,
+			"to", toAddress,
+		)
+		bodyText = truncated
+	}
+	if truncated, ok := truncateBody(bodyHTML, s.backend.config.MaxBodyHTMLSize, htmlTruncationMarker); ok {
+		s.logger.Info("Truncated HTML body for storage",
+			"original_bytes", len(bodyHTML),
+			"max_bytes", s.backend.config.MaxBodyHTMLSize,
+			"to", toAddress,
+		)
+		bodyHTML = truncated
+	}
+
+	// Save email to filesystem
+	filePath, err := s.backend.storage.SaveEmail(toAddress, rawEmail)
+	if err != nil {
+		s.logger.Error("Failed to save email to filesystem",
+			"error", err,
+			"to", toAddress,
+			"from", s.from,
+			"size_bytes", len(rawEmail),
+		)
+		return nil, fmt.Errorf("failed to save email: %w", err)
+	}
+
+	s.logger.Info("Email saved to filesystem",
+		"path", filePath,
+		"to", toAddress,
+		"from", s.from,
+	)
+
 	// Save attachments - enmime already parsed them
 	attachmentPaths := []string{}
 	attachmentNames := []string{}
 	attachmentSizes := []int64{}
+	attachmentDispositions := []string{}
+	attachmentContentIDs := []string{}
+	attachmentTiers := []string{}
 
 	emailFilename := filepath.Base(filePath)
 
@@ -377,7 +676,7 @@ func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
 		if filename == "" {
 			filename = "unnamed"
 		}
-		attPath, err := s.backend.storage.SaveAttachment(emailFilename, filename, att.Content)
+		attPath, err := s.backend.storage.SaveAttachment(toAddress, emailFilename, filename, att.Content)
 		if err != nil {
 			s.logger.Error("Failed to save attachment",
 				"error", err,
@@ -392,6 +691,9 @@ func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
 		attachmentPaths = append(attachmentPaths, attPath)
 		attachmentNames = append(attachmentNames, filename)
 		attachmentSizes = append(attachmentSizes, int64(len(att.Content)))
+		attachmentDispositions = append(attachmentDispositions, "attachment")
+		attachmentContentIDs = append(attachmentContentIDs, att.ContentID)
+		attachmentTiers = append(attachmentTiers, s.backend.storage.AttachmentTier(len(att.Content)))
 
 		s.logger.Info("Attachment saved successfully",
 			"path", attPath,
@@ -408,7 +710,7 @@ func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
 		if filename == "" {
 			filename = "inline_" + att.ContentID
 		}
-		attPath, err := s.backend.storage.SaveAttachment(emailFilename, filename, att.Content)
+		attPath, err := s.backend.storage.SaveAttachment(toAddress, emailFilename, filename, att.Content)
 		if err != nil {
 			s.logger.Error("Failed to save inline attachment",
 				"error", err,
@@ -423,6 +725,9 @@ func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
 		attachmentPaths = append(attachmentPaths, attPath)
 		attachmentNames = append(attachmentNames, filename)
 		attachmentSizes = append(attachmentSizes, int64(len(att.Content)))
+		attachmentDispositions = append(attachmentDispositions, "inline")
+		attachmentContentIDs = append(attachmentContentIDs, att.ContentID)
+		attachmentTiers = append(attachmentTiers, s.backend.storage.AttachmentTier(len(att.Content)))
 
 		s.logger.Info("Inline attachment saved successfully",
 			"path", attPath,
@@ -433,53 +738,154 @@ func (s *Session) processEmail(toAddress string, rawEmail []byte) error {
 		)
 	}
 
-	// Store email via API
-	storeReq := &client.StoreEmailRequest{
+	return &savedMessage{
+		filePath:        filePath,
+		from:            fromHeader,
+		subject:         subject,
+		bodyText:        bodyText,
+		bodyHTML:        bodyHTML,
+		attachmentPaths: attachmentPaths,
+		attachmentNames: attachmentNames,
+		attachmentSizes: attachmentSizes,
+
+		attachmentDispositions: attachmentDispositions,
+		attachmentContentIDs:   attachmentContentIDs,
+		attachmentTiers:        attachmentTiers,
+	}, nil
+}
+
+// newStoreRequest builds the API store request for a saved email
+func newStoreRequest(toAddress string, rawEmail []byte, msg *savedMessage) *client.StoreEmailRequest {
+	return &client.StoreEmailRequest{
 		To:              toAddress,
-		From:            fromHeader,
-		Subject:         subject,
-		BodyText:        bodyText,
-		BodyHTML:        bodyHTML,
+		From:            msg.from,
+		Subject:         msg.subject,
+		BodyText:        msg.bodyText,
+		BodyHTML:        msg.bodyHTML,
 		RawEmail:        string(rawEmail),
-		FilePath:        filePath,
+		FilePath:        msg.filePath,
 		Timestamp:       time.Now().UTC().Format(time.RFC3339),
-		AttachmentPaths: attachmentPaths,
-		AttachmentNames: attachmentNames,
-		AttachmentSizes: attachmentSizes,
+		AttachmentPaths: msg.attachmentPaths,
+		AttachmentNames: msg.attachmentNames,
+		AttachmentSizes: msg.attachmentSizes,
+
+		AttachmentDispositions: msg.attachmentDispositions,
+		AttachmentContentIDs:   msg.attachmentContentIDs,
+		AttachmentTiers:        msg.attachmentTiers,
 	}
+}
+
+// storeMessage sends the metadata of a saved email to the API for a single recipient
+func (s *Session) storeMessage(toAddress string, rawEmail []byte, msg *savedMessage) error {
+	storeReq := newStoreRequest(toAddress, rawEmail, msg)
 
 	s.logger.Info("Storing email metadata via API",
 		"to", toAddress,
-		"from", fromHeader,
-		"subject", subject,
-		"attachment_count", len(attachmentPaths),
+		"from", msg.from,
+		"subject", msg.subject,
+		"attachment_count", len(msg.attachmentPaths),
 	)
 
-	resp, err := s.backend.apiClient.StoreEmail(toAddress, storeReq)
+	resp, err := s.backend.apiClient.StoreEmail(toAddress, s.traceID, storeReq)
 	if err != nil {
-		// Just log the error, don't break the operation - email is already saved to filesystem
+		// The email is already saved to filesystem; the caller decides how to report the failure
 		s.logger.Error("Failed to store email metadata via API (email saved to filesystem)",
 			"error", err,
 			"to", toAddress,
-			"from", fromHeader,
-			"subject", subject,
-			"file_path", filePath,
+			"from", msg.from,
+			"subject", msg.subject,
+			"file_path", msg.filePath,
 			"client_ip", s.clientIP.String(),
 		)
-		return nil
+		return fmt.Errorf("failed to store email metadata: %w", err)
 	}
 
 	s.logger.Info("Email stored successfully in database",
 		"to", toAddress,
-		"from", fromHeader,
-		"subject", subject,
+		"from", msg.from,
+		"subject", msg.subject,
 		"email_id", resp.EmailID,
-		"file_path", filePath,
-		"attachment_count", len(attachmentPaths),
+		"file_path", msg.filePath,
+		"attachment_count", len(msg.attachmentPaths),
 	)
 	return nil
 }
 
+// Markers appended to bodies cut by the storage caps
+const (
+	textTruncationMarker = "\n\n[Message truncated - download the original message for the full content]"
+	htmlTruncationMarker = "<p><em>[Message truncated - download the original message for the full content]</em></p>"
+)
+
+// truncateBody cuts body to at most maxBytes (0 = unlimited) on a UTF-8 boundary and appends marker.
+// It reports whether the body was truncated.
+func truncateBody(body string, maxBytes int, marker string) (string, bool) {
+	if maxBytes <= 0 || len(body) <= maxBytes {
+		return body, false
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return body[:cut] + marker, true
+}
+
+// errSuspiciousAttachmentRatio is returned by saveMessage when the attachment ratio heuristic rejects a message
+var errSuspiciousAttachmentRatio = errors.New("attachment-to-body ratio heuristic rejected message")
+
+// checkAttachmentRatio flags messages whose attachments vastly outweigh their body
+// when other spam signals are also present. It returns true only if the message
+// is flagged and the policy is "reject".
+func (s *Session) checkAttachmentRatio(env *enmime.Envelope, toAddress string) bool {
+	cfg := s.backend.config
+	if cfg.AttachmentRatioPolicy == "off" {
+		return false
+	}
+
+	var attachmentBytes int64
+	for _, att := range env.Attachments {
+		attachmentBytes += int64(len(att.Content))
+	}
+	for _, att := range env.Inlines {
+		attachmentBytes += int64(len(att.Content))
+	}
+	if attachmentBytes < int64(cfg.AttachmentRatioMinBytes) {
+		return false
+	}
+
+	bodyBytes := int64(len(env.Text) + len(env.HTML))
+	ratio := attachmentBytes / max(bodyBytes, 1)
+	if ratio < int64(cfg.AttachmentRatioThreshold) {
+		return false
+	}
+
+	var signals []string
+	if strings.TrimSpace(env.GetHeader("Subject")) == "" {
+		signals = append(signals, "no_subject")
+	}
+	if strings.TrimSpace(env.Text) == "" && strings.TrimSpace(env.HTML) == "" {
+		signals = append(signals, "empty_body")
+	}
+	if a := s.authResult; a != nil && (a.SPFResult == "fail" || a.DKIMResult == "fail" || a.DMARCResult == "fail") {
+		signals = append(signals, "auth_fail")
+	}
+	if len(signals) < cfg.AttachmentRatioMinSignals {
+		return false
+	}
+
+	s.logger.Warn("Email flagged by attachment-to-body ratio heuristic",
+		"policy", cfg.AttachmentRatioPolicy,
+		"attachment_bytes", attachmentBytes,
+		"body_bytes", bodyBytes,
+		"ratio", ratio,
+		"signals", signals,
+		"to", toAddress,
+		"from", s.from,
+		"client_ip", s.clientIP.String(),
+	)
+	return cfg.AttachmentRatioPolicy == "reject"
+}
+
 // Reset is called when RSET command is received
 func (s *Session) Reset() {
 	s.logger.Info("RSET command received, resetting session",
@@ -489,6 +895,10 @@ func (s *Session) Reset() {
 	)
 	s.from = ""
 	s.recipients = nil
+	s.traceID = ""
+	s.authResult = nil
+	s.logger = s.backend.logger
+	s.rejectLogger = s.backend.rejectLogger
 }
 
 // Logout is called when the session is closed
@@ -499,6 +909,13 @@ func (s *Session) Logout() error {
 	return nil
 }
 
+// newTraceID generates a random 16-character hex trace ID for a message
+func newTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // extractEmailAddress extracts email from format like "<user@domain.com>" or "User <user@domain.com>"
 func extractEmailAddress(address string) string {
 	// Remove angle brackets if present
@@ -522,6 +939,23 @@ func extractDomain(email string) string {
 	return ""
 }
 
+// hasDateHeader reports whether the message header contains a Date field.
+// Messages whose header cannot be parsed are treated as having one, so the
+// policy only acts on messages that are otherwise well-formed.
+func hasDateHeader(rawEmail []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(rawEmail))
+	if err != nil {
+		return true
+	}
+	return msg.Header.Get("Date") != ""
+}
+
+// withDateHeader prepends a Date header set to t, keeping the message RFC 5322 complete
+func withDateHeader(rawEmail []byte, t time.Time) []byte {
+	header := "Date: " + t.Format(time.RFC1123Z) + "\r\n"
+	return append([]byte(header), rawEmail...)
+}
+
 // AuthResult holds the result of email authentication checks
 type AuthResult struct {
 	SPFResult   string // pass, fail, softfail, neutral, none, temperror, permerror
@@ -705,16 +1139,18 @@ type HealthServer struct {
 	apiClient *client.APIClient
 	logger    *slog.Logger
 	ready     *atomic.Bool
+	backend   *Backend // Checked for capacity without taking a session slot
 }
 
 // NewHealthServer creates a new health server
-func NewHealthServer(apiClient *client.APIClient, logger *slog.Logger) *HealthServer {
+func NewHealthServer(apiClient *client.APIClient, logger *slog.Logger, backend *Backend) *HealthServer {
 	ready := &atomic.Bool{}
 	ready.Store(false)
 	return &HealthServer{
 		apiClient: apiClient,
 		logger:    logger,
 		ready:     ready,
+		backend:   backend,
 	}
 }
 
@@ -763,8 +1199,17 @@ func (h *HealthServer) ReadinessHandler(w http.ResponseWriter, r *http.Request)
 		allHealthy = false
 	}
 
+	// Report whether new connections would be admitted, without dialing the listener:
+	// a probe connection would take a session slot and could itself be shed
+	if reason := h.backend.capacity(); reason != "" {
+		checks["smtp_capacity"] = "failed: " + reason
+		allHealthy = false
+	} else {
+		checks["smtp_capacity"] = "ok"
+	}
+
 	// Check API connectivity
-	_, err := h.apiClient.ValidateAddress("health-check-test@tmpemail.xyz")
+	_, err := h.apiClient.ValidateAddress("health-check-test@tmpemail.xyz", "")
 	if err != nil {
 		// This might fail with "user unknown" which is expected,
 		// we just want to check connectivity
@@ -799,6 +1244,23 @@ func (h *HealthServer) ReadinessHandler(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// newFileCipher builds the storage cipher from the configured current and old keys
+func newFileCipher(cfg *config.Config) (*storage.Cipher, error) {
+	currentKey, err := storage.ParseKey(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	oldKeys := make([][]byte, 0, len(cfg.EncryptionOldKeys))
+	for _, encoded := range cfg.EncryptionOldKeys {
+		key, err := storage.ParseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid old key: %w", err)
+		}
+		oldKeys = append(oldKeys, key)
+	}
+	return storage.NewCipher(currentKey, oldKeys)
+}
+
 func main() {
 	// Setup logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
@@ -814,26 +1276,83 @@ func main() {
 		"smtp_port", cfg.SMTPPort,
 		"health_port", cfg.HealthPort,
 		"storage_path", cfg.StoragePath,
+		"domain_storage_paths", cfg.DomainStoragePaths,
 		"api_url", cfg.APIServiceURL,
 		"tls_enabled", cfg.TLSEnabled,
 		"validate_spf", cfg.ValidateSPF,
 		"validate_dkim", cfg.ValidateDKIM,
 		"validate_dmarc", cfg.ValidateDMARC,
 		"auth_policy", cfg.AuthPolicy,
+		"bounce_policy", cfg.BouncePolicy,
+		"missing_date_policy", cfg.MissingDatePolicy,
+		"attachment_ratio_policy", cfg.AttachmentRatioPolicy,
+		"on_store_failure", cfg.OnStoreFailure,
 	)
 
-	// Ensure storage directory exists
+	// Ensure storage directories exist
 	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
 		logger.Error("Failed to create storage directory", "error", err)
 		os.Exit(1)
 	}
+	for domain, path := range cfg.DomainStoragePaths {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			logger.Error("Failed to create domain storage directory", "error", err, "domain", domain, "path", path)
+			os.Exit(1)
+		}
+	}
+	if cfg.ColdStoragePath != "" {
+		if err := os.MkdirAll(cfg.ColdStoragePath, 0755); err != nil {
+			logger.Error("Failed to create cold storage directory", "error", err, "path", cfg.ColdStoragePath)
+			os.Exit(1)
+		}
+	}
+	if cfg.OnStoreFailure == "dead-letter" && cfg.DeadLetterPath == "" {
+		logger.Error("TMPEMAIL_ON_STORE_FAILURE=dead-letter requires TMPEMAIL_DEAD_LETTER_PATH")
+		os.Exit(1)
+	}
+
+	// Set up encryption at rest if a key is configured
+	var fileCipher *storage.Cipher
+	if cfg.EncryptionKey != "" {
+		var err error
+		fileCipher, err = newFileCipher(cfg)
+		if err != nil {
+			logger.Error("Failed to initialize storage encryption", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Storage encryption at rest enabled", "old_keys", len(cfg.EncryptionOldKeys))
+	}
 
 	// Initialize components
-	stor := storage.NewStorage(cfg.StoragePath)
-	apiClient := client.NewAPIClient(cfg.APIServiceURL)
+	stor := storage.NewStorageWithOptions(cfg.StoragePath, storage.Options{
+		PreserveAttachmentPaths: cfg.PreserveAttachmentPaths,
+		Cipher:                  fileCipher,
+		DomainPaths:             cfg.DomainStoragePaths,
+		ColdPath:                cfg.ColdStoragePath,
+		ColdThreshold:           cfg.ColdStorageThreshold,
+	})
+	var apiBreaker *client.CircuitBreaker
+	if cfg.APIBreakerThreshold > 0 {
+		apiBreaker = client.NewCircuitBreaker(cfg.APIBreakerThreshold, cfg.APIBreakerCooldown)
+	}
+	apiClient := client.NewAPIClientWithBreaker(cfg.APIServiceURL, cfg.InternalAPIKey, apiBreaker)
+
+	// Create SMTP backend, optionally with a dedicated rejection log
+	var rejectionHandler slog.Handler
+	if cfg.RejectionLogPath != "" {
+		rejectionFile, err := os.OpenFile(cfg.RejectionLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			logger.Error("Failed to open rejection log", "error", err, "path", cfg.RejectionLogPath)
+			os.Exit(1)
+		}
+		defer rejectionFile.Close()
+		rejectionHandler = slog.NewJSONHandler(rejectionFile, &slog.HandlerOptions{Level: slog.LevelInfo})
+		logger.Info("Rejection log enabled", "path", cfg.RejectionLogPath)
+	}
+	backend := NewBackend(stor, apiClient, cfg, logger, rejectionHandler)
 
-	// Create health server
-	healthServer := NewHealthServer(apiClient, logger)
+	// Create health server; readiness checks the backend's capacity
+	healthServer := NewHealthServer(apiClient, logger, backend)
 
 	// Setup HTTP health check server
 	httpMux := http.NewServeMux()
@@ -855,9 +1374,6 @@ func main() {
 		}
 	}()
 
-	// Create SMTP backend
-	backend := NewBackend(stor, apiClient, cfg, logger)
-
 	// Create SMTP server
 	smtpServer := smtp.NewServer(backend)
 	smtpServer.Addr = fmt.Sprintf("%s:%s", cfg.SMTPHost, cfg.SMTPPort)
@@ -887,9 +1403,15 @@ func main() {
 	// Start SMTP server in goroutine
 	go func() {
 		logger.Info("SMTP server starting", "port", cfg.SMTPPort)
-		// Mark as ready once the server starts listening
+		listener, err := net.Listen("tcp", smtpServer.Addr)
+		if err != nil {
+			logger.Error("SMTP server failed", "error", err)
+			os.Exit(1)
+		}
+		// Mark as ready once the listener is bound
 		healthServer.SetReady(true)
-		if err := smtpServer.ListenAndServe(); err != nil {
+		// Overloaded connections are refused before go-smtp sees them
+		if err := smtpServer.Serve(newSheddingListener(listener, backend, smtpServer.Domain)); err != nil {
 			logger.Error("SMTP server failed", "error", err)
 			healthServer.SetReady(false)
 			os.Exit(1)
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"tmpemail_email_service/client"
+	"tmpemail_email_service/config"
+	"tmpemail_email_service/storage"
+)
+
+// stubAPI stands in for the API Service: every address is valid, and store requests
+// are recorded and answered with storeStatus (200 when zero)
+type stubAPI struct {
+	storeStatus int
+
+	mu     sync.Mutex
+	stores []storeCall
+}
+
+// storeCall is one store request received by stubAPI
+type storeCall struct {
+	address string
+	req     client.StoreEmailRequest
+}
+
+func (a *stubAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	address := strings.Split(strings.TrimPrefix(r.URL.Path, "/internal/v1/email/"), "/")[0]
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(client.ValidationResponse{Valid: true})
+		return
+	}
+
+	var req client.StoreEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	a.stores = append(a.stores, storeCall{address: address, req: req})
+	a.mu.Unlock()
+
+	if a.storeStatus != 0 && a.storeStatus != http.StatusOK {
+		http.Error(w, "stub failure", a.storeStatus)
+		return
+	}
+	json.NewEncoder(w).Encode(client.StoreEmailResponse{Success: true, EmailID: "email-" + address})
+}
+
+// storeCalls returns the store requests received so far
+func (a *stubAPI) storeCalls() []storeCall {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]storeCall(nil), a.stores...)
+}
+
+// newTestBackend returns a backend storing under a temporary directory and talking to api
+func newTestBackend(t *testing.T, api *stubAPI, configure func(cfg *config.Config)) *Backend {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	cfg := &config.Config{
+		StoragePath:       t.TempDir(),
+		MaxEmailSize:      1024 * 1024,
+		BouncePolicy:      "silent",
+		MissingDatePolicy: "accept",
+		OnStoreFailure:    "delete",
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewBackend(storage.NewStorage(cfg.StoragePath), client.NewAPIClient(server.URL), cfg, logger, nil)
+}
+
+// newTestSession returns a session on b, as NewSession would for a connected client
+func newTestSession(b *Backend) *Session {
+	return &Session{
+		backend:      b,
+		logger:       b.logger,
+		rejectLogger: b.rejectLogger,
+	}
+}
+
+const testMessage = "From: sender@example.com\r\n" +
+	"To: one@tmpemail.xyz, two@tmpemail.xyz\r\n" +
+	"Subject: Hello\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-ID: <shared-id@example.com>\r\n" +
+	"\r\n" +
+	"Hello both\r\n"
+
+// deliver runs one SMTP transaction on s and returns the DATA result
+func deliver(t *testing.T, s *Session, recipients ...string) error {
+	t.Helper()
+	if err := s.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range recipients {
+		if err := s.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%q): %v", rcpt, err)
+		}
+	}
+	return s.Data(strings.NewReader(testMessage))
+}
+
+func TestDataStoresMessageOncePerRecipient(t *testing.T) {
+	for _, share := range []bool{false, true} {
+		name := "separate copies"
+		if share {
+			name = "shared copy"
+		}
+		t.Run(name, func(t *testing.T) {
+			api := &stubAPI{}
+			b := newTestBackend(t, api, func(cfg *config.Config) { cfg.ShareEMLAcrossRecipients = share })
+
+			if err := deliver(t, newTestSession(b), "one@tmpemail.xyz", "two@tmpemail.xyz"); err != nil {
+				t.Fatalf("Data: %v", err)
+			}
+
+			calls := api.storeCalls()
+			if len(calls) != 2 {
+				t.Fatalf("got %d StoreEmail calls, want 2", len(calls))
+			}
+			if calls[0].address == calls[1].address {
+				t.Errorf("both StoreEmail calls went to %q, want distinct addresses", calls[0].address)
+			}
+
+			var messageIDs []string
+			for _, call := range calls {
+				if call.req.To != call.address {
+					t.Errorf("StoreEmail for %q has To %q", call.address, call.req.To)
+				}
+				msg, err := mail.ReadMessage(strings.NewReader(call.req.RawEmail))
+				if err != nil {
+					t.Fatalf("stored raw email for %q does not parse: %v", call.address, err)
+				}
+				messageIDs = append(messageIDs, msg.Header.Get("Message-ID"))
+			}
+			if messageIDs[0] != "<shared-id@example.com>" || messageIDs[1] != messageIDs[0] {
+				t.Errorf("stored Message-IDs = %q, want both <shared-id@example.com>", messageIDs)
+			}
+		})
+	}
+}
+
+func TestDataDiscardsSharedFilesWhenEveryStoreFails(t *testing.T) {
+	// 404 is permanent, so no recipient can queue a retry and each gives up at once
+	api := &stubAPI{storeStatus: http.StatusNotFound}
+	b := newTestBackend(t, api, func(cfg *config.Config) {
+		cfg.ShareEMLAcrossRecipients = true
+		cfg.OnStoreFailure = "retry"
+		cfg.StoreRetryInterval = time.Minute
+		cfg.StoreRetryAttempts = 1
+		cfg.StoreRetryQueueSize = 10
+	})
+
+	if err := deliver(t, newTestSession(b), "one@tmpemail.xyz", "two@tmpemail.xyz"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if n := len(api.storeCalls()); n != 2 {
+		t.Fatalf("got %d StoreEmail calls, want 2", n)
+	}
+
+	entries, err := os.ReadDir(b.config.StoragePath)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("orphaned file left in storage: %s", entry.Name())
+	}
+}
+
+func TestReleaseMessageKeepsRetainedFiles(t *testing.T) {
+	b := newTestBackend(t, &stubAPI{}, nil)
+	path := filepath.Join(b.config.StoragePath, "kept.eml")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &savedMessage{filePath: path}
+	msg.holders.Add(2)
+	msg.retained.Store(true)
+	b.releaseMessage("one@tmpemail.xyz", msg, b.logger)
+	b.releaseMessage("two@tmpemail.xyz", msg, b.logger)
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file stored for another recipient was removed: %v", err)
+	}
+
+	msg = &savedMessage{filePath: path}
+	msg.holders.Add(2)
+	b.releaseMessage("one@tmpemail.xyz", msg, b.logger)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file removed while another recipient still holds it: %v", err)
+	}
+	b.releaseMessage("two@tmpemail.xyz", msg, b.logger)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file not removed after the last holder gave up: %v", err)
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	const marker = "[cut]"
+
+	tests := []struct {
+		name      string
+		body      string
+		maxBytes  int
+		want      string
+		truncated bool
+	}{
+		{name: "unlimited", body: "hello world", maxBytes: 0, want: "hello world"},
+		{name: "under limit", body: "hello", maxBytes: 10, want: "hello"},
+		{name: "exactly at limit", body: "hello", maxBytes: 5, want: "hello"},
+		{name: "ascii cut", body: "hello world", maxBytes: 5, want: "hello" + marker, truncated: true},
+		// "é" is two bytes; a cut after its first byte backs off to the rune start
+		{name: "inside two-byte rune", body: "caféteria", maxBytes: 4, want: "caf" + marker, truncated: true},
+		{name: "after two-byte rune", body: "caféteria", maxBytes: 5, want: "café" + marker, truncated: true},
+		// "€" is three bytes and "😀" four
+		{name: "inside three-byte rune", body: "€€€", maxBytes: 5, want: "€" + marker, truncated: true},
+		{name: "inside four-byte rune", body: "a😀b", maxBytes: 3, want: "a" + marker, truncated: true},
+		{name: "first rune does not fit", body: "😀", maxBytes: 2, want: marker, truncated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateBody(tt.body, tt.maxBytes, marker)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("truncateBody(%q, %d) = %q, %v; want %q, %v", tt.body, tt.maxBytes, got, truncated, tt.want, tt.truncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateBody(%q, %d) = %q, not valid UTF-8", tt.body, tt.maxBytes, got)
+			}
+		})
+	}
+}
+
+func TestDataKeepsFilesWhenStoreFails(t *testing.T) {
+	api := &stubAPI{storeStatus: http.StatusNotFound}
+	b := newTestBackend(t, api, func(cfg *config.Config) { cfg.OnStoreFailure = "keep" })
+
+	if err := deliver(t, newTestSession(b), "one@tmpemail.xyz"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	entries, err := os.ReadDir(b.config.StoragePath)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Error("saved email was removed after the store failed, want it kept")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// mimeDepthExceeds reports whether the multipart structure of a raw message nests
+// deeper than maxDepth. It only reads part headers and boundaries, so a maliciously
+// nested message is caught before enmime does the expensive full parse. Malformed
+// structures end the scan early and are left to enmime.
+func mimeDepthExceeds(rawEmail []byte, maxDepth int) bool {
+	if maxDepth <= 0 {
+		return false
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(rawEmail))
+	if err != nil {
+		return false
+	}
+
+	return multipartDepthExceeds(msg.Header.Get("Content-Type"), msg.Body, 1, maxDepth)
+}
+
+// multipartDepthExceeds walks a part at the given depth and its children
+func multipartDepthExceeds(contentType string, body io.Reader, depth, maxDepth int) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return false
+	}
+	if depth > maxDepth {
+		return true
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			return false
+		}
+		if multipartDepthExceeds(part.Header.Get("Content-Type"), part, depth+1, maxDepth) {
+			return true
+		}
+	}
+}
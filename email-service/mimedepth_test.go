@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// nestedMessage builds a raw message whose multipart structure nests depth levels deep
+func nestedMessage(depth int) []byte {
+	var b strings.Builder
+	b.WriteString("From: a@example.com\r\nTo: b@example.com\r\nSubject: nested\r\n")
+
+	if depth == 0 {
+		b.WriteString("Content-Type: text/plain\r\n\r\nhello\r\n")
+		return []byte(b.String())
+	}
+
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n")
+	for level := 1; level <= depth; level++ {
+		fmt.Fprintf(&b, "--b%d\r\n", level)
+		if level < depth {
+			fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"b%d\"\r\n\r\n", level+1)
+		} else {
+			b.WriteString("Content-Type: text/plain\r\n\r\nhello\r\n")
+		}
+	}
+	for level := depth; level >= 1; level-- {
+		fmt.Fprintf(&b, "--b%d--\r\n", level)
+	}
+	return []byte(b.String())
+}
+
+func TestMimeDepthExceeds(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []byte
+		maxDepth int
+		want     bool
+	}{
+		{name: "not multipart", raw: nestedMessage(0), maxDepth: 1, want: false},
+		{name: "single level", raw: nestedMessage(1), maxDepth: 1, want: false},
+		{name: "below limit", raw: nestedMessage(3), maxDepth: 5, want: false},
+		{name: "exactly at limit", raw: nestedMessage(5), maxDepth: 5, want: false},
+		{name: "one over limit", raw: nestedMessage(6), maxDepth: 5, want: true},
+		{name: "far over limit", raw: nestedMessage(50), maxDepth: 10, want: true},
+		{name: "limit disabled", raw: nestedMessage(50), maxDepth: 0, want: false},
+		{name: "not a message", raw: []byte("garbage without headers"), maxDepth: 1, want: false},
+		{name: "missing boundary", raw: []byte("Content-Type: multipart/mixed\r\n\r\nbody\r\n"), maxDepth: 1, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mimeDepthExceeds(tt.raw, tt.maxDepth); got != tt.want {
+				t.Errorf("mimeDepthExceeds(maxDepth=%d) = %v, want %v", tt.maxDepth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMimeDepthExceedsSiblingParts(t *testing.T) {
+	// Depth counts nesting, not the number of parts at one level
+	var b strings.Builder
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n")
+	for range 20 {
+		b.WriteString("--outer\r\nContent-Type: text/plain\r\n\r\npart\r\n")
+	}
+	b.WriteString("--outer--\r\n")
+
+	if mimeDepthExceeds([]byte(b.String()), 1) {
+		t.Error("mimeDepthExceeds counted sibling parts as nesting")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package storage
+
+import "errors"
+
+// FreeSpace is not implemented on this platform; callers treat the error as "unknown"
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
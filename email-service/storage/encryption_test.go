@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+func TestCipherDecrypt(t *testing.T) {
+	oldKey, currentKey, otherKey := testKey(t), testKey(t), testKey(t)
+	plaintext := []byte("From: a@example.com\r\n\r\nhello")
+
+	encryptWith := func(key []byte) []byte {
+		c, err := NewCipher(key, nil)
+		if err != nil {
+			t.Fatalf("NewCipher: %v", err)
+		}
+		data, err := c.Encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		return data
+	}
+	tamper := func(data []byte) []byte {
+		data = bytes.Clone(data)
+		data[len(data)-1] ^= 0xff
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "round trip", data: encryptWith(currentKey), want: plaintext},
+		{name: "rotated old key", data: encryptWith(oldKey), want: plaintext},
+		{name: "legacy plaintext", data: plaintext, want: plaintext},
+		{name: "empty plaintext file", data: []byte{}, want: []byte{}},
+		{name: "tampered ciphertext", data: tamper(encryptWith(currentKey)), wantErr: true},
+		{name: "unknown key", data: encryptWith(otherKey), wantErr: true},
+		{name: "truncated key ID", data: encryptWith(currentKey)[:len(encryptionMagic)+2], wantErr: true},
+		{name: "truncated nonce", data: encryptWith(currentKey)[:len(encryptionMagic)+keyIDSize+4], wantErr: true},
+	}
+
+	c, err := NewCipher(currentKey, [][]byte{oldKey})
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Decrypt(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Decrypt succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt error: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decrypt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCipherEncryptUsesCurrentKey(t *testing.T) {
+	oldKey, currentKey := testKey(t), testKey(t)
+	c, err := NewCipher(currentKey, [][]byte{oldKey})
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	data, err := c.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	// A cipher that only knows the current key must be able to read it
+	current, err := NewCipher(currentKey, nil)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	if got, err := current.Decrypt(data); err != nil || string(got) != "secret" {
+		t.Errorf("Decrypt with current key = %q, %v; want %q", got, err, "secret")
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("encrypted data contains the plaintext")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{name: "valid", encoded: base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{name: "too short", encoded: base64.StdEncoding.EncodeToString(make([]byte, 16)), wantErr: true},
+		{name: "not base64", encoded: "not base64!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKey(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseKey(%q) error = %v, wantErr %v", tt.encoded, err, tt.wantErr)
+			}
+		})
+	}
+}
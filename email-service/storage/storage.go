@@ -7,25 +7,97 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 // Storage handles email file storage
 type Storage struct {
 	basePath string
+	opts     Options
 }
 
+// Options configures optional storage behavior
+type Options struct {
+	// PreserveAttachmentPaths keeps the relative directory structure of path-like
+	// attachment names (e.g. "docs/report.pdf") under a per-email directory
+	// instead of flattening them into a single filename
+	PreserveAttachmentPaths bool
+
+	// Cipher encrypts files at rest when set (nil = store plaintext)
+	Cipher *Cipher
+
+	// DomainPaths maps lowercased recipient domains to their own storage root,
+	// isolating tenants on disk. Other domains are stored under the base path.
+	DomainPaths map[string]string
+
+	// ColdPath stores attachments larger than ColdThreshold bytes on separate,
+	// typically cheaper, media (empty = every attachment stays in the hot path)
+	ColdPath      string
+	ColdThreshold int
+}
+
+// Storage tiers recorded per attachment so downloads know which root to read from
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
 // NewStorage creates a new storage instance
 func NewStorage(basePath string) *Storage {
+	return NewStorageWithOptions(basePath, Options{})
+}
+
+// NewStorageWithOptions creates a new storage instance with optional behavior enabled
+func NewStorageWithOptions(basePath string, opts Options) *Storage {
 	return &Storage{
 		basePath: basePath,
+		opts:     opts,
+	}
+}
+
+// Root returns the storage root for a recipient address, chosen by its domain
+func (s *Storage) Root(toAddress string) string {
+	if i := strings.LastIndex(toAddress, "@"); i >= 0 {
+		if path, ok := s.opts.DomainPaths[strings.ToLower(toAddress[i+1:])]; ok {
+			return path
+		}
+	}
+	return s.basePath
+}
+
+// Roots returns every directory the storage writes to: the base path, the
+// per-domain roots and the cold path, without duplicates
+func (s *Storage) Roots() []string {
+	roots := []string{s.basePath}
+	seen := map[string]bool{filepath.Clean(s.basePath): true}
+	add := func(path string) {
+		if path != "" && !seen[filepath.Clean(path)] {
+			seen[filepath.Clean(path)] = true
+			roots = append(roots, path)
+		}
+	}
+	for _, path := range s.opts.DomainPaths {
+		add(path)
 	}
+	add(s.opts.ColdPath)
+	return roots
 }
 
-// SaveEmail saves an email to the filesystem and returns the file path
+// AttachmentTier returns the storage tier for an attachment of the given size
+func (s *Storage) AttachmentTier(size int) string {
+	if s.opts.ColdPath != "" && size > s.opts.ColdThreshold {
+		return TierCold
+	}
+	return TierHot
+}
+
+// SaveEmail saves an email under the recipient's storage root and returns the file path
 func (s *Storage) SaveEmail(toAddress string, rawEmail []byte) (string, error) {
+	basePath := s.Root(toAddress)
+
 	// Ensure storage directory exists
-	if err := os.MkdirAll(s.basePath, 0755); err != nil {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return "", fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
@@ -35,11 +107,16 @@ func (s *Storage) SaveEmail(toAddress string, rawEmail []byte) (string, error) {
 		return "", fmt.Errorf("failed to generate filename: %w", err)
 	}
 
-	filePath := filepath.Join(s.basePath, filename)
+	filePath := filepath.Join(basePath, filename)
+
+	data, err := s.encrypt(rawEmail)
+	if err != nil {
+		return "", err
+	}
 
 	// Write to temporary file first (atomic write)
 	tempPath := filePath + ".tmp"
-	if err := os.WriteFile(tempPath, rawEmail, 0644); err != nil {
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
 		return "", fmt.Errorf("failed to write temporary file: %w", err)
 	}
 
@@ -52,10 +129,16 @@ func (s *Storage) SaveEmail(toAddress string, rawEmail []byte) (string, error) {
 	return filePath, nil
 }
 
-// SaveAttachment saves an attachment to the filesystem and returns the file path
-func (s *Storage) SaveAttachment(emailFilename, attachmentName string, data []byte) (string, error) {
+// SaveAttachment saves an attachment under the recipient's storage root, or the cold
+// path when it is above the cold threshold, and returns the file path
+func (s *Storage) SaveAttachment(toAddress, emailFilename, attachmentName string, data []byte) (string, error) {
+	basePath := s.Root(toAddress)
+	if s.AttachmentTier(len(data)) == TierCold {
+		basePath = s.opts.ColdPath
+	}
+
 	// Ensure storage directory exists
-	if err := os.MkdirAll(s.basePath, 0755); err != nil {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return "", fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
@@ -67,7 +150,29 @@ func (s *Storage) SaveAttachment(emailFilename, attachmentName string, data []by
 	}
 
 	attachmentFilename := fmt.Sprintf("%s_%s", baseEmailName, sanitizeFilename(attachmentName))
-	filePath := filepath.Join(s.basePath, attachmentFilename)
+	filePath := filepath.Join(basePath, attachmentFilename)
+
+	// Keep the hierarchy of path-like names under a directory named after the email
+	if s.opts.PreserveAttachmentPaths {
+		if segments, ok := safeRelativePath(attachmentName); ok && len(segments) > 1 {
+			emailDir := filepath.Join(basePath, baseEmailName)
+			filePath = filepath.Join(append([]string{emailDir}, segments...)...)
+
+			// Defense in depth: the joined path must stay inside the email directory
+			rel, err := filepath.Rel(emailDir, filePath)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return "", fmt.Errorf("attachment path escapes storage directory: %q", attachmentName)
+			}
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return "", fmt.Errorf("failed to create attachment directory: %w", err)
+			}
+		}
+	}
+
+	data, err := s.encrypt(data)
+	if err != nil {
+		return "", err
+	}
 
 	// Write to temporary file first
 	tempPath := filePath + ".tmp"
@@ -123,7 +228,116 @@ func sanitizeFilename(filename string) string {
 	return safe
 }
 
-// ReadEmail reads an email from the filesystem
+// safeRelativePath splits a path-like attachment name into sanitized segments.
+// Returns false if the name contains ".." traversal or is absolute.
+func safeRelativePath(name string) ([]string, bool) {
+	normalized := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(normalized, "/") {
+		return nil, false
+	}
+
+	segments := []string{}
+	for _, part := range strings.Split(normalized, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return nil, false
+		}
+		segments = append(segments, sanitizeFilename(part))
+	}
+	return segments, len(segments) > 0
+}
+
+// ReadEmail reads an email from the filesystem, decrypting it if encryption at rest is enabled
 func (s *Storage) ReadEmail(filePath string) ([]byte, error) {
-	return os.ReadFile(filePath)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.Cipher == nil {
+		return data, nil
+	}
+	return s.opts.Cipher.Decrypt(data)
+}
+
+// encrypt encrypts file contents when encryption at rest is enabled
+func (s *Storage) encrypt(data []byte) ([]byte, error) {
+	if s.opts.Cipher == nil {
+		return data, nil
+	}
+	encrypted, err := s.opts.Cipher.Encrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt file: %w", err)
+	}
+	return encrypted, nil
+}
+
+// DeleteEmail removes a saved email and its attachments, including the per-email
+// directory created for preserved attachment paths once it is empty
+func (s *Storage) DeleteEmail(filePath string, attachmentPaths []string) error {
+	var firstErr error
+	for _, path := range append([]string{filePath}, attachmentPaths...) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	s.removeEmptyEmailDirs(filePath, attachmentPaths)
+	return firstErr
+}
+
+// MoveEmail moves a saved email and its attachments into a directory named after
+// the email under destDir, keeping preserved attachment paths. It returns that directory.
+func (s *Storage) MoveEmail(filePath string, attachmentPaths []string, destDir string) (string, error) {
+	targetDir := filepath.Join(destDir, filepath.Base(strings.TrimSuffix(filePath, ".eml")))
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	var firstErr error
+	for _, path := range append([]string{filePath}, attachmentPaths...) {
+		target := filepath.Join(targetDir, filepath.Base(path))
+		for _, emailDir := range s.emailDirs(filePath) {
+			if rel, err := filepath.Rel(emailDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+				target = filepath.Join(targetDir, rel)
+				break
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to create destination directory: %w", err)
+			}
+			continue
+		}
+		if err := os.Rename(path, target); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to move %s: %w", path, err)
+		}
+	}
+	s.removeEmptyEmailDirs(filePath, attachmentPaths)
+	return targetDir, firstErr
+}
+
+// emailDirs returns the per-email attachment directories an email's preserved
+// attachment paths may be under: next to the .eml file, and in the cold path
+func (s *Storage) emailDirs(filePath string) []string {
+	emailDir := strings.TrimSuffix(filePath, ".eml")
+	dirs := []string{emailDir}
+	if s.opts.ColdPath != "" {
+		dirs = append(dirs, filepath.Join(s.opts.ColdPath, filepath.Base(emailDir)))
+	}
+	return dirs
+}
+
+// removeEmptyEmailDirs removes the directories left empty under the per-email
+// attachment directories, deepest first, stopping at the first non-empty one
+func (s *Storage) removeEmptyEmailDirs(filePath string, attachmentPaths []string) {
+	for _, emailDir := range s.emailDirs(filePath) {
+		for _, path := range attachmentPaths {
+			for dir := filepath.Dir(path); dir == emailDir || strings.HasPrefix(dir, emailDir+string(filepath.Separator)); dir = filepath.Dir(dir) {
+				if os.Remove(dir) != nil {
+					break
+				}
+			}
+		}
+	}
 }
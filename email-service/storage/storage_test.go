@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSafeRelativePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		segments []string
+		ok       bool
+	}{
+		{name: "simple", input: "docs/report.pdf", segments: []string{"docs", "report.pdf"}, ok: true},
+		{name: "single segment", input: "report.pdf", segments: []string{"report.pdf"}, ok: true},
+		{name: "parent traversal", input: "../x", ok: false},
+		{name: "nested traversal", input: "a/../../x", ok: false},
+		{name: "backslash traversal", input: `\..\x`, ok: false},
+		{name: "backslash relative traversal", input: `a\..\x`, ok: false},
+		{name: "absolute", input: "/abs", ok: false},
+		{name: "dot segments", input: "./a/./b", segments: []string{"a", "b"}, ok: true},
+		{name: "empty segments", input: "a//b///c", segments: []string{"a", "b", "c"}, ok: true},
+		{name: "only separators", input: "./", ok: false},
+		{name: "empty", input: "", ok: false},
+		{name: "unsafe characters", input: "a b/c;d", segments: []string{"a_b", "c_d"}, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, ok := safeRelativePath(tt.input)
+			if ok != tt.ok {
+				t.Fatalf("safeRelativePath(%q) ok = %v, want %v", tt.input, ok, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(segments, tt.segments) {
+				t.Errorf("safeRelativePath(%q) = %q, want %q", tt.input, segments, tt.segments)
+			}
+		})
+	}
+}
+
+func TestSaveAttachmentPreservedPathStaysInEmailDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		preserved bool // Saved under the per-email directory rather than flattened
+	}{
+		{name: "nested", input: "docs/2024/report.pdf", preserved: true},
+		{name: "dot segments", input: "./a/./b.txt", preserved: true},
+		{name: "parent traversal", input: "../x", preserved: false},
+		{name: "nested traversal", input: "a/../../x", preserved: false},
+		{name: "backslash traversal", input: `\..\x`, preserved: false},
+		{name: "absolute", input: "/etc/passwd", preserved: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			s := NewStorageWithOptions(base, Options{PreserveAttachmentPaths: true})
+
+			path, err := s.SaveAttachment("user@example.com", "abc.eml", tt.input, []byte("data"))
+			if err != nil {
+				t.Fatalf("SaveAttachment(%q) error: %v", tt.input, err)
+			}
+
+			rel, err := filepath.Rel(base, path)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				t.Fatalf("SaveAttachment(%q) = %q, outside storage root %q", tt.input, path, base)
+			}
+
+			emailDir := filepath.Join(base, "abc") + string(filepath.Separator)
+			if got := strings.HasPrefix(path, emailDir); got != tt.preserved {
+				t.Errorf("SaveAttachment(%q) = %q, under email directory = %v, want %v", tt.input, path, got, tt.preserved)
+			}
+			if !tt.preserved && filepath.Dir(path) != base {
+				t.Errorf("SaveAttachment(%q) = %q, want a flattened file directly under %q", tt.input, path, base)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != "data" {
+				t.Errorf("saved file %q = %q, %v; want %q", path, data, err, "data")
+			}
+		})
+	}
+}
+
+// saveTieredEmail saves an email with a small and a large preserved-path attachment,
+// the large one going to the cold path
+func saveTieredEmail(t *testing.T, s *Storage) (string, []string) {
+	t.Helper()
+	emailPath, err := s.SaveEmail("user@example.com", []byte("raw"))
+	if err != nil {
+		t.Fatalf("SaveEmail: %v", err)
+	}
+	emailFilename := filepath.Base(emailPath)
+
+	var paths []string
+	for name, data := range map[string]string{"docs/small.txt": "small", "docs/big/large.bin": "0123456789"} {
+		path, err := s.SaveAttachment("user@example.com", emailFilename, name, []byte(data))
+		if err != nil {
+			t.Fatalf("SaveAttachment(%q): %v", name, err)
+		}
+		paths = append(paths, path)
+	}
+	return emailPath, paths
+}
+
+// assertEmpty fails if dir contains anything
+func assertEmpty(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", dir, err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s left behind in %s", entry.Name(), dir)
+	}
+}
+
+func TestDeleteEmailRemovesColdEmailDir(t *testing.T) {
+	hot, cold := t.TempDir(), t.TempDir()
+	s := NewStorageWithOptions(hot, Options{PreserveAttachmentPaths: true, ColdPath: cold, ColdThreshold: 8})
+
+	emailPath, paths := saveTieredEmail(t, s)
+	if err := s.DeleteEmail(emailPath, paths); err != nil {
+		t.Fatalf("DeleteEmail: %v", err)
+	}
+
+	assertEmpty(t, hot)
+	assertEmpty(t, cold)
+}
+
+func TestMoveEmailKeepsColdAttachmentPaths(t *testing.T) {
+	hot, cold, dest := t.TempDir(), t.TempDir(), t.TempDir()
+	s := NewStorageWithOptions(hot, Options{PreserveAttachmentPaths: true, ColdPath: cold, ColdThreshold: 8})
+
+	emailPath, paths := saveTieredEmail(t, s)
+	targetDir, err := s.MoveEmail(emailPath, paths, dest)
+	if err != nil {
+		t.Fatalf("MoveEmail: %v", err)
+	}
+
+	for _, rel := range []string{filepath.Base(emailPath), "docs/small.txt", "docs/big/large.bin"} {
+		if _, err := os.Stat(filepath.Join(targetDir, rel)); err != nil {
+			t.Errorf("moved email is missing %s: %v", rel, err)
+		}
+	}
+	assertEmpty(t, hot)
+	assertEmpty(t, cold)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"tmpemail_email_service/client"
+)
+
+// storeFailure is a recipient whose email was saved to disk but not stored by the API
+type storeFailure struct {
+	address string
+	msg     *savedMessage
+	req     *client.StoreEmailRequest
+	err     error
+}
+
+// handleStoreFailure applies the TMPEMAIL_ON_STORE_FAILURE policy to the files of an
+// email the API would not store. Files shared with other recipients are only removed
+// by the last one to give up, and never once any of them was stored. It returns true
+// when the email was queued for a retry, which counts as a delivery.
+func (s *Session) handleStoreFailure(f storeFailure) bool {
+	switch s.backend.config.OnStoreFailure {
+	case "keep":
+		return false
+	case "retry":
+		// An unknown or expired address will never accept the email
+		if !client.IsPermanent(f.err) && s.backend.storeRetries.enqueue(&storeRetry{
+			address: f.address,
+			traceID: s.traceID,
+			msg:     f.msg,
+			req:     f.req,
+		}) {
+			s.logger.Info("Queued email metadata for retry",
+				"to", f.address,
+				"file_path", f.msg.filePath,
+				"retry_in", s.backend.config.StoreRetryInterval.String(),
+			)
+			return true
+		}
+	}
+
+	s.backend.releaseMessage(f.address, f.msg, s.logger)
+	return false
+}
+
+// releaseMessage drops a failed recipient's hold on the files of msg and discards
+// them when it was the last holder and no recipient's email was stored
+func (b *Backend) releaseMessage(address string, msg *savedMessage, logger *slog.Logger) {
+	if msg.holders.Add(-1) > 0 || msg.retained.Load() {
+		return
+	}
+	b.discardMessage(address, msg, logger)
+}
+
+// discardMessage removes the files of an email that could not be stored, moving them
+// to the dead-letter directory instead when one is configured and the policy allows it
+func (b *Backend) discardMessage(address string, msg *savedMessage, logger *slog.Logger) {
+	if b.config.DeadLetterPath != "" && b.config.OnStoreFailure != "delete" {
+		dir, err := b.storage.MoveEmail(msg.filePath, msg.attachmentPaths, b.config.DeadLetterPath)
+		if err != nil {
+			logger.Error("Failed to dead-letter unstored email", "error", err, "to", address, "file_path", msg.filePath)
+			return
+		}
+		logger.Warn("Moved unstored email to dead-letter directory", "to", address, "path", dir)
+		return
+	}
+
+	if err := b.storage.DeleteEmail(msg.filePath, msg.attachmentPaths); err != nil {
+		logger.Error("Failed to delete unstored email", "error", err, "to", address, "file_path", msg.filePath)
+		return
+	}
+	logger.Warn("Deleted unstored email", "to", address, "file_path", msg.filePath)
+}
+
+// storeRetry is an email waiting for another attempt to store its metadata
+type storeRetry struct {
+	address  string
+	traceID  string
+	msg      *savedMessage
+	req      *client.StoreEmailRequest // RawEmail is re-read from disk on each attempt
+	attempts int
+	nextAt   time.Time
+}
+
+// storeRetryQueue retries storing email metadata in the background. Entries are
+// held in memory only; the files of emails still queued at shutdown stay on disk.
+type storeRetryQueue struct {
+	backend *Backend
+	queue   chan *storeRetry
+}
+
+// newStoreRetryQueue creates a retry queue and starts its worker
+func newStoreRetryQueue(b *Backend) *storeRetryQueue {
+	q := &storeRetryQueue{
+		backend: b,
+		queue:   make(chan *storeRetry, max(b.config.StoreRetryQueueSize, 1)),
+	}
+	go q.run()
+	return q
+}
+
+// enqueue schedules the next attempt for an email. It returns false when the queue is full.
+func (q *storeRetryQueue) enqueue(r *storeRetry) bool {
+	r.nextAt = time.Now().Add(q.backend.config.StoreRetryInterval)
+	select {
+	case q.queue <- r:
+		return true
+	default:
+		return false
+	}
+}
+
+// run processes queued emails in order; every entry waits the same interval, so
+// waiting for the head of the queue never delays an entry that is already due
+func (q *storeRetryQueue) run() {
+	for r := range q.queue {
+		time.Sleep(time.Until(r.nextAt))
+		q.attempt(r)
+	}
+}
+
+// attempt retries a single email and requeues or discards it on failure
+func (q *storeRetryQueue) attempt(r *storeRetry) {
+	b := q.backend
+	logger := b.logger.With("to", r.address, "file_path", r.msg.filePath)
+	r.attempts++
+
+	rawEmail, err := b.storage.ReadEmail(r.msg.filePath)
+	if err != nil {
+		logger.Error("Failed to read email for store retry, dropping", "error", err)
+		b.releaseMessage(r.address, r.msg, logger)
+		return
+	}
+	req := *r.req
+	req.RawEmail = string(rawEmail)
+
+	resp, err := b.apiClient.StoreEmail(r.address, r.traceID, &req)
+	if err == nil {
+		r.msg.retained.Store(true)
+		logger.Info("Email stored successfully on retry", "email_id", resp.EmailID, "attempts", r.attempts)
+		return
+	}
+
+	if !client.IsPermanent(err) && r.attempts < b.config.StoreRetryAttempts {
+		if q.enqueue(r) {
+			logger.Warn("Store retry failed, requeued", "error", err, "attempts", r.attempts)
+			return
+		}
+	}
+
+	logger.Error("Giving up storing email metadata", "error", err, "attempts", r.attempts)
+	b.releaseMessage(r.address, r.msg, logger)
+}